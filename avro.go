@@ -0,0 +1,347 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// avroSchema is a parsed Avro schema, enough of it to decode data
+// written with it to values which can be encoded as JSON.
+type avroSchema struct {
+	Type    string
+	Name    string
+	Fields  []avroField
+	Symbols []string
+	Items   *avroSchema
+	Values  *avroSchema
+	Size    int
+	Union   []*avroSchema
+}
+
+type avroField struct {
+	Name string
+	Type *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+// parseAvroSchema parses an Avro schema from its JSON definition.
+func parseAvroSchema(definition string) (*avroSchema, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(definition), &raw); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	return parseAvroType(raw, map[string]*avroSchema{}, "")
+}
+
+func parseAvroType(raw interface{}, names map[string]*avroSchema, namespace string) (*avroSchema, error) {
+	switch t := raw.(type) {
+	case string:
+		if avroPrimitives[t] {
+			return &avroSchema{Type: t}, nil
+		}
+		if named, ok := names[t]; ok {
+			return named, nil
+		}
+		if named, ok := names[fullAvroName(t, namespace)]; ok {
+			return named, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", t)
+
+	case []interface{}:
+		union := &avroSchema{Type: "union"}
+		for _, member := range t {
+			s, err := parseAvroType(member, names, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.Union = append(union.Union, s)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return parseAvroComplex(t, names, namespace)
+	}
+
+	return nil, fmt.Errorf("invalid type %v", raw)
+}
+
+func parseAvroComplex(raw map[string]interface{}, names map[string]*avroSchema, namespace string) (*avroSchema, error) {
+	typeName, _ := raw["type"].(string)
+	if len(typeName) == 0 {
+		// The type of a field can itself be a schema object or union.
+		if nested, ok := raw["type"]; ok {
+			return parseAvroType(nested, names, namespace)
+		}
+		return nil, fmt.Errorf("schema has no type")
+	}
+
+	s := &avroSchema{Type: typeName}
+
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := raw["name"].(string)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("%s has no name", typeName)
+		}
+		if val, ok := raw["namespace"].(string); ok && len(val) > 0 {
+			namespace = val
+		}
+		s.Name = fullAvroName(name, namespace)
+		if i := strings.LastIndex(s.Name, "."); i >= 0 {
+			namespace = s.Name[:i]
+		}
+		// Named types are registered first so records can refer to
+		// themselves.
+		names[s.Name] = s
+	}
+
+	switch typeName {
+	case "record", "error":
+		s.Type = "record"
+		fields, _ := raw["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if len(name) == 0 {
+				return nil, fmt.Errorf("field of %s has no name", s.Name)
+			}
+			fieldType, err := parseAvroType(field["type"], names, namespace)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of %s: %s", name, s.Name, err)
+			}
+			s.Fields = append(s.Fields, avroField{Name: name, Type: fieldType})
+		}
+
+	case "enum":
+		symbols, _ := raw["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			name, _ := symbol.(string)
+			s.Symbols = append(s.Symbols, name)
+		}
+
+	case "fixed":
+		size, _ := raw["size"].(float64)
+		s.Size = int(size)
+
+	case "array":
+		items, err := parseAvroType(raw["items"], names, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("array items: %s", err)
+		}
+		s.Items = items
+
+	case "map":
+		values, err := parseAvroType(raw["values"], names, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("map values: %s", err)
+		}
+		s.Values = values
+
+	default:
+		// Primitives can be given as objects to add a logical type, the
+		// underlying value is decoded.
+		if !avroPrimitives[typeName] {
+			return parseAvroType(typeName, names, namespace)
+		}
+	}
+
+	return s, nil
+}
+
+func fullAvroName(name, namespace string) string {
+	if strings.Contains(name, ".") || len(namespace) == 0 {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroReader reads Avro's binary encoding from a buffer.
+type avroReader struct {
+	data []byte
+}
+
+// decodeAvro decodes data written with schema. Records and maps become
+// JSON objects, unions are their value without the type, and bytes and
+// fixed become base64 strings when encoded as JSON.
+func decodeAvro(schema *avroSchema, data []byte) (interface{}, error) {
+	r := &avroReader{data: data}
+	value, err := r.decode(schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("%d bytes left over after decoding", len(r.data))
+	}
+	return value, nil
+}
+
+func (r *avroReader) decode(s *avroSchema) (interface{}, error) {
+	switch s.Type {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+
+	case "int", "long":
+		return r.long()
+
+	case "float":
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+
+	case "double":
+		b, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+
+	case "bytes", "string":
+		size, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("negative length %d", size)
+		}
+		b, err := r.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+		if s.Type == "string" {
+			return string(b), nil
+		}
+		return b, nil
+
+	case "fixed":
+		return r.read(s.Size)
+
+	case "enum":
+		index, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(s.Symbols)) {
+			return nil, fmt.Errorf("enum index %d out of range for %s", index, s.Name)
+		}
+		return s.Symbols[index], nil
+
+	case "union":
+		index, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(s.Union)) {
+			return nil, fmt.Errorf("union index %d out of range", index)
+		}
+		return r.decode(s.Union[index])
+
+	case "record":
+		record := make(map[string]interface{}, len(s.Fields))
+		for _, field := range s.Fields {
+			value, err := r.decode(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			record[field.Name] = value
+		}
+		return record, nil
+
+	case "array":
+		items := []interface{}{}
+		err := r.blocks(func() error {
+			item, err := r.decode(s.Items)
+			items = append(items, item)
+			return err
+		})
+		return items, err
+
+	case "map":
+		values := map[string]interface{}{}
+		err := r.blocks(func() error {
+			key, err := r.decode(&avroSchema{Type: "string"})
+			if err != nil {
+				return err
+			}
+			value, err := r.decode(s.Values)
+			values[key.(string)] = value
+			return err
+		})
+		return values, err
+	}
+
+	return nil, fmt.Errorf("unsupported type %q", s.Type)
+}
+
+// blocks reads the blocks of an array or map, calling item for each of
+// their items.
+func (r *avroReader) blocks(item func() error) error {
+	for {
+		count, err := r.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the block's size in bytes.
+			count = -count
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+		if count > int64(len(r.data)) {
+			return fmt.Errorf("block of %d items exceeds the data", count)
+		}
+
+		for i := int64(0); i < count; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long reads a zig-zag encoded variable-length integer.
+func (r *avroReader) long() (int64, error) {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	r.data = r.data[n:]
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+func (r *avroReader) read(size int) ([]byte, error) {
+	if size < 0 || size > len(r.data) {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	b := r.data[:size]
+	r.data = r.data[size:]
+	return b, nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// avroLong zig-zag encodes v as Avro writes ints and longs.
+func avroLong(v int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, uint64((v<<1)^(v>>63)))
+	return b[:n]
+}
+
+func avroString(s string) []byte {
+	return append(avroLong(int64(len(s))), s...)
+}
+
+func avroData(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func Test_avroReader_long(t *testing.T) {
+	cases := []struct {
+		encoded []byte
+		value   int64
+	}{
+		{encoded: []byte{0x00}, value: 0},
+		{encoded: []byte{0x01}, value: -1},
+		{encoded: []byte{0x02}, value: 1},
+		{encoded: []byte{0x03}, value: -2},
+		{encoded: []byte{0x7f}, value: -64},
+		{encoded: []byte{0x80, 0x01}, value: 64},
+		{encoded: []byte{0xfe, 0xff, 0xff, 0xff, 0x0f}, value: math.MaxInt32},
+		{encoded: []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, value: math.MinInt32},
+		{encoded: avroLong(math.MaxInt64), value: math.MaxInt64},
+		{encoded: avroLong(math.MinInt64), value: math.MinInt64},
+	}
+
+	for _, c := range cases {
+		r := &avroReader{data: c.encoded}
+		value, err := r.long()
+		if err != nil {
+			t.Errorf("long(% x) unexpected error: %s", c.encoded, err)
+			continue
+		}
+		if value != c.value {
+			t.Errorf("long(% x) want %d, got %d", c.encoded, c.value, value)
+		}
+		if len(r.data) != 0 {
+			t.Errorf("long(% x) left %d bytes unread", c.encoded, len(r.data))
+		}
+	}
+}
+
+func Test_decodeAvro(t *testing.T) {
+	float := make([]byte, 4)
+	binary.LittleEndian.PutUint32(float, math.Float32bits(1.5))
+	double := make([]byte, 8)
+	binary.LittleEndian.PutUint64(double, math.Float64bits(-2.25))
+
+	cases := []struct {
+		name   string
+		schema string
+		data   []byte
+		json   string
+	}{
+		{name: "null", schema: `"null"`, data: nil, json: `null`},
+		{name: "boolean true", schema: `"boolean"`, data: []byte{1}, json: `true`},
+		{name: "boolean false", schema: `"boolean"`, data: []byte{0}, json: `false`},
+		{name: "int", schema: `"int"`, data: avroLong(-42), json: `-42`},
+		{name: "long", schema: `"long"`, data: avroLong(1 << 40), json: `1099511627776`},
+		{name: "float", schema: `"float"`, data: float, json: `1.5`},
+		{name: "double", schema: `"double"`, data: double, json: `-2.25`},
+		{name: "string", schema: `"string"`, data: avroString("héllo"), json: `"héllo"`},
+		{name: "empty string", schema: `"string"`, data: avroLong(0), json: `""`},
+		{name: "bytes", schema: `"bytes"`, data: avroString("\x00\x01"), json: `"AAE="`},
+		{name: "logical type", schema: `{"type":"long","logicalType":"timestamp-millis"}`, data: avroLong(1500), json: `1500`},
+		{name: "fixed", schema: `{"type":"fixed","name":"pair","size":2}`, data: []byte{0xff, 0x00}, json: `"/wA="`},
+		{name: "enum", schema: `{"type":"enum","name":"suit","symbols":["hearts","spades"]}`, data: avroLong(1), json: `"spades"`},
+		{name: "union null", schema: `["null","string"]`, data: avroLong(0), json: `null`},
+		{name: "union string", schema: `["null","string"]`, data: avroData(avroLong(1), avroString("set")), json: `"set"`},
+		{
+			name:   "array",
+			schema: `{"type":"array","items":"int"}`,
+			data:   avroData(avroLong(3), avroLong(1), avroLong(2), avroLong(3), avroLong(0)),
+			json:   `[1,2,3]`,
+		},
+		{
+			name:   "array in blocks",
+			schema: `{"type":"array","items":"int"}`,
+			data:   avroData(avroLong(1), avroLong(7), avroLong(-2), avroLong(2), avroLong(8), avroLong(9), avroLong(0)),
+			json:   `[7,8,9]`,
+		},
+		{name: "empty array", schema: `{"type":"array","items":"int"}`, data: avroLong(0), json: `[]`},
+		{
+			name:   "map",
+			schema: `{"type":"map","values":"long"}`,
+			data:   avroData(avroLong(2), avroString("a"), avroLong(1), avroString("b"), avroLong(2), avroLong(0)),
+			json:   `{"a":1,"b":2}`,
+		},
+		{
+			name: "record",
+			schema: `{"type":"record","name":"Order","namespace":"shop","fields":[
+				{"name":"id","type":"long"},
+				{"name":"customer","type":{"type":"record","name":"Customer","fields":[{"name":"name","type":"string"}]}},
+				{"name":"coupon","type":["null","string"]},
+				{"name":"tags","type":{"type":"array","items":"string"}}
+			]}`,
+			data: avroData(
+				avroLong(7),
+				avroString("Ada"),
+				avroLong(0),
+				avroLong(1), avroString("gift"), avroLong(0),
+			),
+			json: `{"coupon":null,"customer":{"name":"Ada"},"id":7,"tags":["gift"]}`,
+		},
+		{
+			name: "recursive record",
+			schema: `{"type":"record","name":"Node","fields":[
+				{"name":"value","type":"int"},
+				{"name":"next","type":["null","Node"]}
+			]}`,
+			data: avroData(avroLong(1), avroLong(1), avroLong(2), avroLong(0)),
+			json: `{"next":{"next":null,"value":2},"value":1}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			schema, err := parseAvroSchema(c.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, err := decodeAvro(schema, c.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != c.json {
+				t.Errorf("want %s, got %s", c.json, encoded)
+			}
+		})
+	}
+}
+
+func Test_decodeAvro_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		data   []byte
+	}{
+		{name: "truncated varint", schema: `"long"`, data: []byte{0x80}},
+		{name: "truncated double", schema: `"double"`, data: []byte{0, 0, 0}},
+		{name: "truncated string", schema: `"string"`, data: avroData(avroLong(5), []byte("abc"))},
+		{name: "negative length", schema: `"bytes"`, data: avroLong(-1)},
+		{name: "enum out of range", schema: `{"type":"enum","name":"e","symbols":["a"]}`, data: avroLong(1)},
+		{name: "union out of range", schema: `["null","int"]`, data: avroLong(2)},
+		{name: "block larger than data", schema: `{"type":"array","items":"null"}`, data: avroLong(1000)},
+		{name: "bytes left over", schema: `"int"`, data: avroData(avroLong(1), avroLong(2))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			schema, err := parseAvroSchema(c.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := decodeAvro(schema, c.data); err == nil {
+				t.Errorf("want an error, got %v", value)
+			}
+		})
+	}
+}
+
+func Test_parseAvroSchema_Invalid(t *testing.T) {
+	cases := []string{
+		`not json`,
+		`"decimal"`,
+		`{"type":"record","fields":[]}`,
+		`{"type":"record","name":"r","fields":[{"type":"int"}]}`,
+		`{"type":"record","name":"r","fields":[{"name":"f","type":"Unknown"}]}`,
+		`{"type":"array","items":"Unknown"}`,
+		`{"name":"untyped"}`,
+	}
+
+	for _, definition := range cases {
+		if schema, err := parseAvroSchema(definition); err == nil {
+			t.Errorf("parseAvroSchema(%s) want an error, got %+v", definition, schema)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// batch is the messages received on a topic which have not been
+// dispatched yet, it is dispatched once it is full or at its deadline.
+type batch struct {
+	items    []consumed
+	deadline time.Time
+}
+
+// batcher accumulates messages into a batch per topic. It is only used
+// from the consumer loop so is not safe for concurrent use.
+type batcher struct {
+	size    int
+	timeout time.Duration
+	pending map[string]*batch
+
+	timer *time.Timer
+	armed time.Time
+}
+
+func newBatcher(size int, timeout time.Duration) *batcher {
+	return &batcher{
+		size:    size,
+		timeout: timeout,
+		pending: make(map[string]*batch),
+	}
+}
+
+// Add appends item to its topic's batch, returning the batch when it is
+// full.
+func (b *batcher) Add(item consumed) []consumed {
+	topic := item.msg.Topic
+	pending, ok := b.pending[topic]
+	if !ok {
+		pending = &batch{deadline: time.Now().Add(b.timeout)}
+		b.pending[topic] = pending
+	}
+
+	pending.items = append(pending.items, item)
+	if len(pending.items) < b.size {
+		return nil
+	}
+
+	delete(b.pending, topic)
+	return pending.items
+}
+
+// Expired removes and returns the batches whose deadline has passed.
+func (b *batcher) Expired() [][]consumed {
+	now := time.Now()
+	expired := [][]consumed{}
+	for topic, pending := range b.pending {
+		if !now.Before(pending.deadline) {
+			expired = append(expired, pending.items)
+			delete(b.pending, topic)
+		}
+	}
+	return expired
+}
+
+// Flush removes and returns every batch regardless of its deadline, it
+// returns nothing when batching is disabled and b is nil.
+func (b *batcher) Flush() [][]consumed {
+	if b == nil {
+		return nil
+	}
+
+	flushed := make([][]consumed, 0, len(b.pending))
+	for topic, pending := range b.pending {
+		flushed = append(flushed, pending.items)
+		delete(b.pending, topic)
+	}
+	return flushed
+}
+
+// C returns a channel which receives at the earliest deadline of the
+// pending batches, or nil when there are none or b is nil.
+func (b *batcher) C() <-chan time.Time {
+	if b == nil || len(b.pending) == 0 {
+		return nil
+	}
+
+	var earliest time.Time
+	for _, pending := range b.pending {
+		if earliest.IsZero() || pending.deadline.Before(earliest) {
+			earliest = pending.deadline
+		}
+	}
+
+	if b.timer == nil || !earliest.Equal(b.armed) {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		b.timer = time.NewTimer(time.Until(earliest))
+		b.armed = earliest
+	}
+	return b.timer.C
+}
+
+// batchMessage combines the values of msgs into the body of a single
+// invocation, either as a JSON array or as newline-delimited values.
+// Values which are not valid JSON are added to an array as strings and
+// empty values, such as tombstones, as null. The message has the topic,
+// partition and offset of the first of msgs.
+func batchMessage(msgs []*sarama.ConsumerMessage, format string) *sarama.ConsumerMessage {
+	body := bytes.Buffer{}
+
+	if format == "ndjson" {
+		for _, msg := range msgs {
+			body.Write(bytes.TrimRight(msg.Value, "\n"))
+			body.WriteByte('\n')
+		}
+	} else {
+		body.WriteByte('[')
+		for i, msg := range msgs {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			if len(msg.Value) == 0 {
+				body.WriteString("null")
+			} else if json.Valid(msg.Value) {
+				body.Write(msg.Value)
+			} else {
+				value, _ := json.Marshal(string(msg.Value))
+				body.Write(value)
+			}
+		}
+		body.WriteByte(']')
+	}
+
+	first := msgs[0]
+	return &sarama.ConsumerMessage{
+		Topic:     first.Topic,
+		Partition: first.Partition,
+		Offset:    first.Offset,
+		Timestamp: first.Timestamp,
+		Value:     body.Bytes(),
+	}
+}
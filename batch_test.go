@@ -0,0 +1,138 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func batchItem(topic string, offset int64) consumed {
+	return consumed{msg: &sarama.ConsumerMessage{Topic: topic, Offset: offset, Value: []byte(`{}`)}}
+}
+
+func Test_batcher_FlushesOnSize(t *testing.T) {
+	b := newBatcher(3, time.Minute)
+
+	for offset := int64(1); offset <= 2; offset++ {
+		if full := b.Add(batchItem("orders", offset)); full != nil {
+			t.Fatalf("want no batch before batch_size, got %d messages", len(full))
+		}
+	}
+	// Other topics are batched on their own.
+	if full := b.Add(batchItem("payments", 1)); full != nil {
+		t.Fatalf("want no batch for payments, got %d messages", len(full))
+	}
+
+	full := b.Add(batchItem("orders", 3))
+	if len(full) != 3 {
+		t.Fatalf("want a batch of 3 once batch_size is reached, got %d", len(full))
+	}
+	for i, item := range full {
+		if item.msg.Topic != "orders" || item.msg.Offset != int64(i+1) {
+			t.Errorf("want orders offset %d at %d, got %s offset %d", i+1, i, item.msg.Topic, item.msg.Offset)
+		}
+	}
+
+	// The full batch is removed, the next one starts empty.
+	if full := b.Add(batchItem("orders", 4)); full != nil {
+		t.Fatalf("want a new batch started, got %d messages", len(full))
+	}
+}
+
+func Test_batcher_FlushesOnTimeout(t *testing.T) {
+	b := newBatcher(10, 20*time.Millisecond)
+
+	if b.C() != nil {
+		t.Fatalf("want no timer without pending batches")
+	}
+
+	b.Add(batchItem("orders", 1))
+	b.Add(batchItem("orders", 2))
+	if expired := b.Expired(); len(expired) != 0 {
+		t.Fatalf("want nothing expired before batch_timeout, got %d batches", len(expired))
+	}
+
+	select {
+	case <-b.C():
+	case <-time.After(time.Second):
+		t.Fatalf("want the timer to fire at batch_timeout")
+	}
+
+	expired := b.Expired()
+	if len(expired) != 1 || len(expired[0]) != 2 {
+		t.Fatalf("want the partial batch of 2 expired, got %v", expired)
+	}
+	if b.C() != nil {
+		t.Fatalf("want no timer once the batch has expired")
+	}
+}
+
+func Test_batcher_FlushesPartialBatchesOnShutdown(t *testing.T) {
+	b := newBatcher(10, time.Minute)
+	b.Add(batchItem("orders", 1))
+	b.Add(batchItem("orders", 2))
+	b.Add(batchItem("payments", 1))
+
+	flushed := b.Flush()
+	if len(flushed) != 2 {
+		t.Fatalf("want a partial batch per topic, got %d", len(flushed))
+	}
+	sizes := map[string]int{}
+	for _, items := range flushed {
+		sizes[items[0].msg.Topic] = len(items)
+	}
+	if sizes["orders"] != 2 || sizes["payments"] != 1 {
+		t.Fatalf("want 2 orders and 1 payment flushed, got %v", sizes)
+	}
+
+	if flushed := b.Flush(); len(flushed) != 0 {
+		t.Fatalf("want nothing left after a flush, got %d batches", len(flushed))
+	}
+
+	// Batching is disabled with a nil batcher.
+	var disabled *batcher
+	if disabled.Flush() != nil || disabled.C() != nil {
+		t.Fatalf("want a nil batcher to have nothing to flush")
+	}
+}
+
+func Test_batchMessage(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "orders", Partition: 2, Offset: 10, Value: []byte(`{"id":1}`)},
+		{Topic: "orders", Partition: 2, Offset: 11, Value: []byte("plain text")},
+		{Topic: "orders", Partition: 2, Offset: 12, Value: []byte("[1,2]\n")},
+	}
+
+	cases := []struct {
+		format string
+		body   string
+	}{
+		{format: "json", body: `[{"id":1},"plain text",[1,2]` + "\n]"},
+		{format: "ndjson", body: "{\"id\":1}\nplain text\n[1,2]\n"},
+	}
+
+	for _, c := range cases {
+		batch := batchMessage(msgs, c.format)
+		if string(batch.Value) != c.body {
+			t.Errorf("%s: want body %q, got %q", c.format, c.body, batch.Value)
+		}
+		if batch.Topic != "orders" || batch.Partition != 2 || batch.Offset != 10 {
+			t.Errorf("%s: want the first message's position, got %s/%d/%d", c.format, batch.Topic, batch.Partition, batch.Offset)
+		}
+	}
+}
+
+func Test_batchMessage_Tombstones(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "users", Key: []byte("a"), Value: []byte(`{"name":"Ada"}`)},
+		{Topic: "users", Key: []byte("b"), Value: nil},
+	}
+
+	if batch := batchMessage(msgs, "json"); string(batch.Value) != `[{"name":"Ada"},null]` {
+		t.Errorf("want a tombstone as null, got %s", batch.Value)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a function's circuit breaker, its value
+// is reported by the kafka_connector_circuit_breaker_state metric.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// functionBreaker is the breaker of one function. Its generation is
+// incremented on every change of state, so the results of invocations
+// allowed before the change can be told apart.
+type functionBreaker struct {
+	state      breakerState
+	failures   int
+	openedAt   time.Time
+	generation uint64
+}
+
+// breakers holds a circuit breaker per function. A breaker opens after
+// threshold consecutive failures and short-circuits invocations until
+// timeout has passed, then lets a single trial invocation through which
+// closes it again on success or re-opens it on failure. Only the trial
+// can close or re-open a half-open breaker, the results of invocations
+// allowed before it opened are ignored.
+type breakers struct {
+	threshold int
+	timeout   time.Duration
+	functions map[string]*functionBreaker
+	lock      sync.Mutex
+}
+
+func newBreakers(threshold int, timeout time.Duration) *breakers {
+	return &breakers{
+		threshold: threshold,
+		timeout:   timeout,
+		functions: make(map[string]*functionBreaker),
+	}
+}
+
+// Allow reports whether function may be invoked along with the
+// breaker's generation, every invocation allowed must be followed by a
+// call to Result with it. A threshold of 0 disables the breakers.
+func (b *breakers) Allow(function string) (uint64, bool) {
+	if b.threshold <= 0 {
+		return 0, true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	fb := b.get(function)
+	switch fb.state {
+	case breakerOpen:
+		if time.Since(fb.openedAt) < b.timeout {
+			return 0, false
+		}
+		// The invocation which moves the breaker to half-open is its
+		// trial, any others wait for its result.
+		b.transition(function, fb, breakerHalfOpen)
+		return fb.generation, true
+	case breakerHalfOpen:
+		return 0, false
+	}
+	return fb.generation, true
+}
+
+// Result records whether an invocation of function allowed in generation
+// succeeded. Results from an earlier generation are ignored.
+func (b *breakers) Result(function string, generation uint64, success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	fb := b.get(function)
+	if generation != fb.generation {
+		return
+	}
+
+	if success {
+		fb.failures = 0
+		if fb.state != breakerClosed {
+			b.transition(function, fb, breakerClosed)
+		}
+		return
+	}
+
+	fb.failures++
+	if fb.state == breakerHalfOpen || fb.failures >= b.threshold {
+		fb.openedAt = time.Now()
+		if fb.state != breakerOpen {
+			b.transition(function, fb, breakerOpen)
+		}
+	}
+}
+
+func (b *breakers) get(function string) *functionBreaker {
+	fb, ok := b.functions[function]
+	if !ok {
+		fb = &functionBreaker{}
+		b.functions[function] = fb
+	}
+	return fb
+}
+
+func (b *breakers) transition(function string, fb *functionBreaker, state breakerState) {
+	fb.state = state
+	fb.generation++
+	breakerStates.WithLabelValues(function).Set(float64(state))
+
+	logEvent(levelWarn, "Circuit breaker changed state", logFields{
+		"function": function,
+		"state":    state.String(),
+		"failures": fb.failures,
+	})
+}
@@ -0,0 +1,125 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func breakerStateOf(b *breakers, function string) breakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.get(function).state
+}
+
+// openBreaker fails the threshold of invocations of function.
+func openBreaker(t *testing.T, b *breakers, function string) {
+	for i := 0; i < b.threshold; i++ {
+		generation, allowed := b.Allow(function)
+		if !allowed {
+			t.Fatalf("want invocation %d allowed while closed", i+1)
+		}
+		b.Result(function, generation, false)
+	}
+	if state := breakerStateOf(b, function); state != breakerOpen {
+		t.Fatalf("want the breaker open after %d failures, got %s", b.threshold, state)
+	}
+}
+
+func Test_breakers_Cycle(t *testing.T) {
+	b := newBreakers(3, 20*time.Millisecond)
+
+	// A success resets the failures, so they must be consecutive.
+	for _, success := range []bool{false, false, true, false, false, true} {
+		generation, _ := b.Allow("billing")
+		b.Result("billing", generation, success)
+	}
+	if state := breakerStateOf(b, "billing"); state != breakerClosed {
+		t.Fatalf("want the breaker closed, got %s", state)
+	}
+
+	openBreaker(t, b, "billing")
+	if _, allowed := b.Allow("billing"); allowed {
+		t.Fatalf("want invocations short-circuited while open")
+	}
+
+	// Other functions have breakers of their own.
+	if _, allowed := b.Allow("shipping"); !allowed {
+		t.Fatalf("want other functions allowed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	trial, allowed := b.Allow("billing")
+	if !allowed {
+		t.Fatalf("want a trial allowed after the timeout")
+	}
+	if state := breakerStateOf(b, "billing"); state != breakerHalfOpen {
+		t.Fatalf("want the breaker half-open, got %s", state)
+	}
+	if _, allowed := b.Allow("billing"); allowed {
+		t.Fatalf("want a single trial while half-open")
+	}
+
+	b.Result("billing", trial, true)
+	if state := breakerStateOf(b, "billing"); state != breakerClosed {
+		t.Fatalf("want the breaker closed by the trial, got %s", state)
+	}
+	if _, allowed := b.Allow("billing"); !allowed {
+		t.Fatalf("want invocations allowed once closed")
+	}
+}
+
+func Test_breakers_FailedTrialReopens(t *testing.T) {
+	b := newBreakers(2, 20*time.Millisecond)
+	openBreaker(t, b, "billing")
+	time.Sleep(30 * time.Millisecond)
+
+	trial, _ := b.Allow("billing")
+	b.Result("billing", trial, false)
+
+	if state := breakerStateOf(b, "billing"); state != breakerOpen {
+		t.Fatalf("want the breaker re-opened by the failed trial, got %s", state)
+	}
+	if _, allowed := b.Allow("billing"); allowed {
+		t.Fatalf("want invocations short-circuited for another timeout")
+	}
+}
+
+func Test_breakers_IgnoresResultsFromBeforeOpening(t *testing.T) {
+	b := newBreakers(2, 20*time.Millisecond)
+
+	// A slow invocation is allowed while the breaker is closed.
+	slow, _ := b.Allow("billing")
+
+	openBreaker(t, b, "billing")
+	time.Sleep(30 * time.Millisecond)
+	trial, _ := b.Allow("billing")
+
+	// It succeeds while the trial is still in flight.
+	b.Result("billing", slow, true)
+	if state := breakerStateOf(b, "billing"); state != breakerHalfOpen {
+		t.Fatalf("want the breaker left half-open, got %s", state)
+	}
+	if _, allowed := b.Allow("billing"); allowed {
+		t.Fatalf("want no second trial while the first is in flight")
+	}
+
+	b.Result("billing", trial, false)
+	if state := breakerStateOf(b, "billing"); state != breakerOpen {
+		t.Fatalf("want the breaker re-opened by the trial, got %s", state)
+	}
+}
+
+func Test_breakers_Disabled(t *testing.T) {
+	b := newBreakers(0, time.Second)
+	for i := 0; i < 10; i++ {
+		generation, allowed := b.Allow("billing")
+		if !allowed {
+			t.Fatalf("want every invocation allowed with a threshold of 0")
+		}
+		b.Result("billing", generation, false)
+	}
+}
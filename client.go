@@ -0,0 +1,36 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// makeClient creates an HTTP client for the gateway which keeps idle
+// connections open for reuse between invocations according to config and
+// verifies the gateway with config.GatewayTLS. The proxy env-vars are
+// used unless config.NoProxyGateway is set.
+func makeClient(timeout time.Duration, config connectorConfig) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if config.NoProxyGateway {
+		proxy = nil
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 10 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        config.MaxIdleConns,
+			MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+			IdleConnTimeout:     config.IdleConnTimeout,
+			TLSClientConfig:     config.GatewayTLS,
+		},
+		Timeout: timeout,
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// testConfig builds the configuration from the defaults along with vars.
+func testConfig(vars map[string]string) connectorConfig {
+	all := map[string]string{"topics": "orders"}
+	for key, val := range vars {
+		all[key] = val
+	}
+	defer setEnv(all)()
+
+	return buildConnectorConfig()
+}
+
+func testMessage(offset int64) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 0,
+		Offset:    offset,
+		Value:     []byte(`{"id":1}`),
+	}
+}
+
+// newCountingServer starts a gateway which responds with 200 and counts
+// the connections opened to it.
+func newCountingServer() (*httptest.Server, func() int) {
+	lock := sync.Mutex{}
+	connections := 0
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			connections++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+
+	return server, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return connections
+	}
+}
+
+func Test_makeClient_ReusesConnections(t *testing.T) {
+	server, connections := newCountingServer()
+	defer server.Close()
+
+	config := testConfig(map[string]string{"gateway_url": server.URL})
+	client := makeClient(time.Second, config)
+	limiters := newRateLimiters(config.RateLimit)
+
+	for i := 0; i < 10; i++ {
+		res := invokeFunction(client, limiters, config, "billing", testMessage(int64(i)), 0)
+		if res.Error != nil || res.Status != http.StatusOK {
+			t.Fatalf("invocation %d failed: %d %v", i, res.Status, res.Error)
+		}
+	}
+
+	if got := connections(); got != 1 {
+		t.Fatalf("want sequential invocations to share 1 connection, got %d", got)
+	}
+}
+
+func Benchmark_makeClient_SequentialInvocations(b *testing.B) {
+	server, connections := newCountingServer()
+	defer server.Close()
+
+	config := testConfig(map[string]string{"gateway_url": server.URL})
+	client := makeClient(time.Second, config)
+	limiters := newRateLimiters(config.RateLimit)
+	msg := testMessage(1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		invokeFunction(client, limiters, config, "billing", msg, 0)
+	}
+	b.StopTimer()
+
+	if got := connections(); got != 1 {
+		b.Errorf("want sequential invocations to share 1 connection, got %d", got)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// clusterConfig is an additional Kafka cluster to consume from, with
+// brokers, topics and authentication of its own. Its messages are
+// invoked, published and dead-lettered the same as those consumed from
+// the brokers in broker_host.
+type clusterConfig struct {
+	Name    string
+	Brokers []string
+	Topics  []string
+	Group   string
+
+	SASLUser         string
+	SASLPassword     string
+	SASLPasswordFile string
+	SASLMechanism    string
+
+	TLS            *tls.Config
+	BrokerCAFile   string
+	BrokerCertFile string
+	BrokerKeyFile  string
+}
+
+var clusterName = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// parseClusters reads the settings of each cluster named in names from
+// env-vars prefixed with the cluster's name, i.e. the brokers of the
+// cluster "eu" are read from eu_broker_host. Clusters use the default
+// consumer group unless they set their own, invalid settings are passed
+// to invalid.
+func parseClusters(names string, defaultGroup string, invalid func(format string, args ...interface{})) []clusterConfig {
+	clusters := []clusterConfig{}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if !clusterName.MatchString(name) {
+			invalid("Cluster name %q is not valid, it must only contain letters, digits and underscores", name)
+			continue
+		}
+
+		env := func(key string) string {
+			return os.Getenv(name + "_" + key)
+		}
+
+		c := clusterConfig{
+			Name:             name,
+			Group:            defaultGroup,
+			SASLUser:         env("sasl_user"),
+			SASLPassword:     env("sasl_password"),
+			SASLPasswordFile: env("sasl_password_file"),
+			SASLMechanism:    sarama.SASLTypePlaintext,
+			BrokerCAFile:     env("broker_ca_file"),
+			BrokerCertFile:   env("broker_cert_file"),
+			BrokerKeyFile:    env("broker_key_file"),
+		}
+
+		for _, broker := range strings.Split(env("broker_host"), ",") {
+			broker = strings.TrimSpace(broker)
+			if len(broker) > 0 {
+				c.Brokers = append(c.Brokers, withDefaultPort(broker))
+			}
+		}
+		if len(c.Brokers) == 0 {
+			invalid("%s_broker_host must be set for cluster %s", name, name)
+		}
+
+		for _, topic := range strings.Split(env("topics"), ",") {
+			topic = strings.TrimSpace(topic)
+			if len(topic) > 0 && !contains(c.Topics, topic) {
+				c.Topics = append(c.Topics, topic)
+			}
+		}
+		if len(c.Topics) == 0 {
+			invalid("%s_topics must list at least one topic for cluster %s", name, name)
+		}
+
+		if val := env("consumer_group"); len(val) > 0 {
+			c.Group = val
+		}
+
+		if val := env("sasl_mechanism"); len(val) > 0 {
+			c.SASLMechanism = strings.ToUpper(val)
+		}
+		switch c.SASLMechanism {
+		case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		default:
+			invalid("Unsupported %s_sasl_mechanism %q, must be one of: %s, %s, %s", name,
+				c.SASLMechanism, sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512)
+		}
+
+		// The secrets are read the same way as they are reloaded.
+		password, tlsConfig, err := reloadSecrets(c.apply(connectorConfig{}))
+		if err != nil {
+			invalid("Unable to read the secrets for cluster %s: %s", name, err)
+		}
+		c.SASLPassword, c.TLS = password, tlsConfig
+
+		if len(c.SASLUser) > 0 && len(c.SASLPassword) == 0 {
+			invalid("%s_sasl_user was given without %s_sasl_password or %s_sasl_password_file", name, name, name)
+		}
+
+		clusters = append(clusters, c)
+	}
+
+	return clusters
+}
+
+// apply returns config with the brokers, consumer group and
+// authentication of the cluster, so it can be used to connect to it.
+func (c clusterConfig) apply(config connectorConfig) connectorConfig {
+	config.Brokers = c.Brokers
+	config.Group = c.Group
+	config.TopicGroups = nil
+
+	config.SASLUser = c.SASLUser
+	config.SASLPassword = c.SASLPassword
+	config.SASLPasswordFile = c.SASLPasswordFile
+	config.SASLMechanism = c.SASLMechanism
+
+	config.TLS = c.TLS
+	config.BrokerCAFile = c.BrokerCAFile
+	config.BrokerCertFile = c.BrokerCertFile
+	config.BrokerKeyFile = c.BrokerKeyFile
+
+	return config
+}
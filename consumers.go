@@ -0,0 +1,342 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+)
+
+// consumed is a message along with the consumer which received it, so
+// its offset is marked with the consumer group it belongs to.
+type consumed struct {
+	msg      *sarama.ConsumerMessage
+	consumer offsetMarker
+}
+
+// groupConsumer is a member of a consumer group, it is implemented by the
+// consumers of sarama-cluster.
+type groupConsumer interface {
+	offsetMarker
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	Notifications() <-chan *cluster.Notification
+	Subscriptions() map[string][]int32
+	Close() error
+}
+
+// groupNotification is a rebalance notification from a consumer group.
+type groupNotification struct {
+	group string
+	*cluster.Notification
+}
+
+// consumerSet runs consumers for each consumer group the topics are
+// split between and for each additional cluster, and merges their
+// messages, errors and notifications. Each group is joined by
+// ConsumerInstances consumers which share its partitions.
+type consumerSet struct {
+	consumers map[string][]groupConsumer
+
+	// clusters are the names of the consumers of additional clusters,
+	// which are prefixed with the cluster's name
+	clusters map[string]bool
+
+	messages      chan consumed
+	errors        chan error
+	notifications chan groupNotification
+
+	// closed receives the group of a consumer whose messages channel
+	// closed before the set was closed
+	closed chan string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newConsumerSet joins a consumer group for each group in config's topic
+// groups which has topics, topics without a group and any topics matching
+// whitelist are consumed with config.Group. The topics of each of
+// config's additional clusters are consumed with a consumer of their own.
+func newConsumerSet(brokers []string, config connectorConfig, topics []string, whitelist *regexp.Regexp) (*consumerSet, error) {
+	groups := map[string][]string{}
+	for _, topic := range topics {
+		group := config.Group
+		if val, ok := config.TopicGroups[topic]; ok {
+			group = val
+		}
+		groups[group] = append(groups[group], topic)
+	}
+
+	set := makeConsumerSet()
+
+	for group, groupTopics := range groups {
+		if group == config.Group {
+			continue
+		}
+
+		if err := set.join(brokers, config, group, group, groupTopics, nil, nil); err != nil {
+			set.Close()
+			return nil, err
+		}
+	}
+
+	if len(groups[config.Group]) > 0 || whitelist != nil {
+		// Topics which belong to other groups are never consumed with
+		// the default group even when they match the whitelist.
+		var blacklist *regexp.Regexp
+		if whitelist != nil && len(config.TopicGroups) > 0 {
+			names := make([]string, 0, len(config.TopicGroups))
+			for topic := range config.TopicGroups {
+				names = append(names, regexp.QuoteMeta(topic))
+			}
+			sort.Strings(names)
+			blacklist = regexp.MustCompile("^(?:" + strings.Join(names, "|") + ")$")
+		}
+
+		if err := set.join(brokers, config, config.Group, config.Group, groups[config.Group], whitelist, blacklist); err != nil {
+			set.Close()
+			return nil, err
+		}
+	}
+
+	for _, c := range config.Clusters {
+		name := c.Name + "/" + c.Group
+		set.clusters[name] = true
+		if err := set.join(c.Brokers, c.apply(config), name, c.Group, c.Topics, nil, nil); err != nil {
+			set.Close()
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+func makeConsumerSet() *consumerSet {
+	return &consumerSet{
+		consumers:     make(map[string][]groupConsumer),
+		clusters:      make(map[string]bool),
+		messages:      make(chan consumed),
+		errors:        make(chan error),
+		notifications: make(chan groupNotification),
+		closed:        make(chan string),
+		done:          make(chan struct{}),
+	}
+}
+
+// join adds config.ConsumerInstances consumers of group to the set as
+// name.
+func (s *consumerSet) join(brokers []string, config connectorConfig, name, group string, topics []string, whitelist, blacklist *regexp.Regexp) error {
+	for i := 0; i < config.ConsumerInstances; i++ {
+		consumer, err := newConsumer(brokers, config, group, topics, whitelist, blacklist)
+		if err != nil {
+			return err
+		}
+		s.add(name, consumer)
+	}
+	return nil
+}
+
+// add forwards the consumer's messages, errors and notifications to the
+// set's until it is closed.
+func (s *consumerSet) add(group string, consumer groupConsumer) {
+	s.consumers[group] = append(s.consumers[group], consumer)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		errors := consumer.Errors()
+		notifications := consumer.Notifications()
+		for {
+			select {
+			case msg, ok := <-consumer.Messages():
+				if !ok {
+					// The set closes its consumers only after forwarding
+					// stops, so this consumer stopped by itself.
+					select {
+					case s.closed <- group:
+					case <-s.done:
+					}
+					return
+				}
+				select {
+				case s.messages <- consumed{msg: msg, consumer: consumer}:
+				case <-s.done:
+					// The message was never dispatched so is left unmarked
+					// to be consumed again.
+					return
+				}
+			case err, ok := <-errors:
+				if !ok {
+					errors = nil
+					continue
+				}
+				select {
+				case s.errors <- err:
+				case <-s.done:
+					return
+				}
+			case ntf, ok := <-notifications:
+				if !ok {
+					notifications = nil
+					continue
+				}
+				select {
+				case s.notifications <- groupNotification{group: group, Notification: ntf}:
+				case <-s.done:
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Messages returns the messages received by every consumer.
+func (s *consumerSet) Messages() <-chan consumed { return s.messages }
+
+// Errors returns the errors of every consumer.
+func (s *consumerSet) Errors() <-chan error { return s.errors }
+
+// Notifications returns the rebalance notifications of every consumer.
+func (s *consumerSet) Notifications() <-chan groupNotification { return s.notifications }
+
+// Closed returns the groups of consumers which stopped unexpectedly.
+func (s *consumerSet) Closed() <-chan string { return s.closed }
+
+// CommitOffsets commits the marked offsets of every consumer, returning
+// the first error.
+func (s *consumerSet) CommitOffsets() error {
+	var firstErr error
+	for _, consumers := range s.consumers {
+		for _, consumer := range consumers {
+			if err := consumer.CommitOffsets(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Close stops forwarding and closes every consumer.
+func (s *consumerSet) Close() {
+	close(s.done)
+	s.wg.Wait()
+
+	for group, consumers := range s.consumers {
+		for _, consumer := range consumers {
+			if err := consumer.Close(); err != nil {
+				log.Printf("Unable to close the consumer for group %s: %s", group, err)
+			}
+		}
+	}
+}
+
+// startLagMonitors monitors the lag of each consumer of client's
+// cluster, returning a function which stops them all.
+func (s *consumerSet) startLagMonitors(client sarama.Client, config connectorConfig) func() {
+	stops := make([]func(), 0, len(s.consumers))
+	for group, consumers := range s.consumers {
+		if s.clusters[group] {
+			continue
+		}
+		for _, consumer := range consumers {
+			stops = append(stops, startLagMonitor(client, group, consumer, config.LagInterval))
+		}
+	}
+
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// newConsumer joins the consumer group to consume the topics and any
+// other topics matching whitelist but not blacklist when they are set.
+func newConsumer(brokers []string, config connectorConfig, group string, topics []string, whitelist, blacklist *regexp.Regexp) (*cluster.Consumer, error) {
+	//setup consumer
+	cConfig := cluster.NewConfig()
+	cConfig.Version = config.KafkaVersion
+	cConfig.ClientID = config.ClientID
+	cConfig.Consumer.Return.Errors = true
+	cConfig.Consumer.Offsets.Initial = config.InitialOffset
+	cConfig.Group.Return.Notifications = true
+	cConfig.Group.Session.Timeout = config.SessionTimeout
+	cConfig.Group.Heartbeat.Interval = config.HeartbeatInterval
+	cConfig.Group.Topics.Whitelist = whitelist
+	cConfig.Group.Topics.Blacklist = blacklist
+	if whitelist != nil {
+		// New topics matching the whitelist are found when the metadata
+		// is refreshed, which is checked twice per refresh.
+		cConfig.Metadata.RefreshFrequency = config.TopicRefreshInterval * 2
+	}
+	cConfig.Group.PartitionStrategy = config.RebalanceStrategy
+	cConfig.Consumer.MaxProcessingTime = config.MaxProcessingTime
+	cConfig.Consumer.Fetch.Min = config.FetchMinBytes
+	cConfig.Consumer.Fetch.Default = config.FetchDefaultBytes
+	cConfig.Consumer.Fetch.Max = config.FetchMaxBytes
+	cConfig.Consumer.MaxWaitTime = config.FetchMaxWait
+	cConfig.Consumer.IsolationLevel = config.IsolationLevel
+	cConfig.Consumer.Offsets.CommitInterval = config.CommitInterval
+	if config.ManualCommit {
+		// The consumer always commits in the background, with manual
+		// commits it only does so rarely as a fallback.
+		cConfig.Consumer.Offsets.CommitInterval = time.Hour
+	}
+	applySASL(&cConfig.Config, config)
+	applyTLS(&cConfig.Config, config)
+
+	if whitelist != nil {
+		log.Printf("Binding to topics: %v and topics matching %s with consumer group: %s", topics, whitelist, group)
+	} else {
+		log.Printf("Binding to topics: %v with consumer group: %s", topics, group)
+	}
+
+	// The consumer sorts the topics it is given so it gets its own copy.
+	return cluster.NewConsumer(brokers, group, append([]string{}, topics...), cConfig)
+}
+
+// fatalConsumerErrors can't be recovered from until the configuration or
+// the brokers' ACLs are changed.
+var fatalConsumerErrors = []error{
+	sarama.ErrSASLAuthenticationFailed,
+	sarama.ErrTopicAuthorizationFailed,
+	sarama.ErrGroupAuthorizationFailed,
+	sarama.ErrClusterAuthorizationFailed,
+	sarama.ErrClosedClient,
+}
+
+// describeConsumerError returns the log fields of an error from a
+// consumer and whether it is one of the fatalConsumerErrors.
+func describeConsumerError(err error) (logFields, bool) {
+	fields := logFields{"error": err.Error()}
+
+	cause := err
+	switch e := err.(type) {
+	case *sarama.ConsumerError:
+		fields["topic"] = e.Topic
+		fields["partition"] = e.Partition
+		cause = e.Err
+	case *cluster.Error:
+		// The cause isn't exported, only its message.
+		fields["context"] = e.Ctx
+	}
+
+	for _, fatal := range fatalConsumerErrors {
+		if cause == fatal || cause.Error() == fatal.Error() {
+			return fields, true
+		}
+	}
+	return fields, false
+}
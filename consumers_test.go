@@ -0,0 +1,165 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+)
+
+// fakeGroupConsumer is a group member whose channels are driven by the
+// test.
+type fakeGroupConsumer struct {
+	fakeMarker
+	messages      chan *sarama.ConsumerMessage
+	errors        chan error
+	notifications chan *cluster.Notification
+	closed        bool
+}
+
+func newFakeGroupConsumer() *fakeGroupConsumer {
+	return &fakeGroupConsumer{
+		messages:      make(chan *sarama.ConsumerMessage),
+		errors:        make(chan error),
+		notifications: make(chan *cluster.Notification),
+	}
+}
+
+func (f *fakeGroupConsumer) Messages() <-chan *sarama.ConsumerMessage { return f.messages }
+
+func (f *fakeGroupConsumer) Errors() <-chan error { return f.errors }
+
+func (f *fakeGroupConsumer) Notifications() <-chan *cluster.Notification { return f.notifications }
+
+func (f *fakeGroupConsumer) Subscriptions() map[string][]int32 { return nil }
+
+func (f *fakeGroupConsumer) Close() error {
+	f.closed = true
+	return nil
+}
+
+func Test_consumerSet_ReportsClosedConsumer(t *testing.T) {
+	set := makeConsumerSet()
+	consumer := newFakeGroupConsumer()
+	set.add("billing", consumer)
+
+	msg := testMessage(1)
+	consumer.messages <- msg
+	select {
+	case item := <-set.Messages():
+		if item.msg != msg {
+			t.Fatalf("want the consumer's message forwarded, got %v", item.msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("want the consumer's message forwarded")
+	}
+
+	// The brokers went away so the consumer closed its messages channel.
+	close(consumer.messages)
+
+	select {
+	case group := <-set.Closed():
+		if group != "billing" {
+			t.Fatalf("want group billing reported closed, got %s", group)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("want the closed consumer reported")
+	}
+
+	set.Close()
+	if !consumer.closed {
+		t.Fatalf("want the consumer closed with the set")
+	}
+}
+
+func Test_consumerSet_ClosedBySetIsNotReported(t *testing.T) {
+	set := makeConsumerSet()
+	consumer := newFakeGroupConsumer()
+	set.add("billing", consumer)
+
+	set.Close()
+
+	select {
+	case group := <-set.Closed():
+		t.Fatalf("want nothing reported once the set is closed, got %s", group)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// fakeClock is a clock which only moves when sleep is called.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(delay time.Duration) {
+	c.sleeps = append(c.sleeps, delay)
+	c.now = c.now.Add(delay)
+}
+
+func Test_connectConsumerSet_BacksOff(t *testing.T) {
+	config := testConfig(map[string]string{"connect_max_interval": "8s"})
+
+	attempts := 0
+	create := func() (*consumerSet, error) {
+		attempts++
+		if attempts <= 5 {
+			return nil, fmt.Errorf("kafka: client has run out of available brokers")
+		}
+		return makeConsumerSet(), nil
+	}
+	clock := &fakeClock{now: time.Now()}
+
+	consumers, err := connectConsumerSet(create, config, clock.Now, clock.Sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumers == nil {
+		t.Fatalf("want the consumer set created")
+	}
+	if attempts != 6 {
+		t.Fatalf("want 6 attempts, got %d", attempts)
+	}
+	if len(clock.sleeps) != 5 {
+		t.Fatalf("want a wait after each failed attempt, got %v", clock.sleeps)
+	}
+
+	// Each wait is jittered down to at most half the doubling backoff.
+	backoff := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, delay := range clock.sleeps {
+		if delay < backoff[i]/2 || delay > backoff[i] {
+			t.Errorf("attempt %d want a wait between %s and %s, got %s", i+1, backoff[i]/2, backoff[i], delay)
+		}
+	}
+}
+
+func Test_connectConsumerSet_Timeout(t *testing.T) {
+	config := testConfig(map[string]string{
+		"connect_timeout":      "10s",
+		"connect_max_interval": "2s",
+	})
+
+	attempts := 0
+	create := func() (*consumerSet, error) {
+		attempts++
+		return nil, fmt.Errorf("kafka: client has run out of available brokers")
+	}
+	// Every wait is exactly 2s so the attempts fall at 0s, 2s, 4s, 6s, 8s
+	// and 10s, when connect_timeout has passed.
+	clock := &fakeClock{now: time.Now()}
+	sleep := func(delay time.Duration) { clock.Sleep(2 * time.Second) }
+
+	if _, err := connectConsumerSet(create, config, clock.Now, sleep); err == nil {
+		t.Fatalf("want an error once connect_timeout has passed")
+	}
+	if attempts != 6 {
+		t.Fatalf("want 6 attempts within connect_timeout, got %d", attempts)
+	}
+}
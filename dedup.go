@@ -0,0 +1,103 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// dedupCache remembers the keys of recently seen messages so duplicates
+// can be skipped. It is best-effort: it is held in memory so is lost on
+// restart and not shared between replicas, and the least recently seen
+// keys are evicted once it holds size keys.
+type dedupCache struct {
+	ttl    time.Duration
+	size   int
+	header string
+
+	entries map[string]*list.Element
+	order   *list.List
+	lock    sync.Mutex
+}
+
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+func newDedupCache(ttl time.Duration, size int, header string) *dedupCache {
+	return &dedupCache{
+		ttl:     ttl,
+		size:    size,
+		header:  header,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Key returns the key msg is deduplicated by on its topic. The key is
+// the value of the header when one is configured, otherwise the
+// message's key. Messages without one are never duplicates so the key
+// is empty, as it is when deduplication is disabled.
+func (d *dedupCache) Key(msg *sarama.ConsumerMessage) string {
+	if d == nil {
+		return ""
+	}
+
+	key := string(msg.Key)
+	if len(d.header) > 0 {
+		key = recordHeader(msg, d.header)
+	}
+	if len(key) == 0 {
+		return ""
+	}
+	return msg.Topic + "\x00" + key
+}
+
+// Seen reports whether a message with key was processed within the TTL.
+func (d *dedupCache) Seen(key string) bool {
+	if d == nil || len(key) == 0 {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	element, ok := d.entries[key]
+	if !ok {
+		return false
+	}
+	d.order.MoveToFront(element)
+	return time.Since(element.Value.(*dedupEntry).seenAt) < d.ttl
+}
+
+// Remember records that the message with key was processed. It is
+// called once every function succeeded or the message was dead-lettered,
+// so a message whose invocation failed is not skipped when redelivered.
+func (d *dedupCache) Remember(key string) {
+	if d == nil || len(key) == 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if element, ok := d.entries[key]; ok {
+		element.Value.(*dedupEntry).seenAt = now
+		d.order.MoveToFront(element)
+		return
+	}
+
+	d.entries[key] = d.order.PushFront(&dedupEntry{key: key, seenAt: now})
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+}
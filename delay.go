@@ -0,0 +1,178 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// notBefore reads the time msg should not be processed before from its
+// header, either RFC3339 or milliseconds since the epoch. It returns
+// false when the header is not set.
+func notBefore(msg *sarama.ConsumerMessage, header string) (time.Time, bool, error) {
+	val := recordHeader(msg, header)
+	if len(val) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	if millis, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), true, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, val); err == nil {
+		return parsed, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("%s %q is not RFC3339 or milliseconds since the epoch", header, val)
+}
+
+// maxDelayed is how many messages can be held until they are due before
+// the consumer stops reading until some are dispatched.
+const maxDelayed = 1024
+
+// delayed is a message held until it is due.
+type delayed struct {
+	item consumed
+	due  time.Time
+	lane uint32
+}
+
+// delayQueue holds the messages which are not due yet according to their
+// delay header, so they don't take a worker while they wait. With
+// ordering, later messages which would share a delayed message's key lane
+// are held behind it so they are still processed in order. It is only
+// used from the consumer loop so is not safe for concurrent use.
+type delayQueue struct {
+	header   string
+	maxDelay time.Duration
+	ordered  bool
+	batched  bool
+	held     []delayed
+
+	timer *time.Timer
+	armed time.Time
+}
+
+func newDelayQueue(header string, maxDelay time.Duration, ordered, batched bool) *delayQueue {
+	return &delayQueue{
+		header:   header,
+		maxDelay: maxDelay,
+		ordered:  ordered,
+		batched:  batched,
+	}
+}
+
+// Hold keeps item until it is due, for up to maxDelay, and returns true.
+// It returns false for items which are due now, or when q is nil.
+func (q *delayQueue) Hold(item consumed) bool {
+	if q == nil {
+		return false
+	}
+
+	msg := item.msg
+	now := time.Now()
+	due, ok, err := notBefore(msg, q.header)
+	if err != nil {
+		logEvent(levelWarn, "Ignoring invalid delay header", logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"error":     err.Error(),
+		})
+	}
+
+	if ok && due.After(now) {
+		fields := logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"delay":     due.Sub(now).String(),
+		}
+		if due.Sub(now) > q.maxDelay {
+			fields["max_delay"] = q.maxDelay.String()
+			logEvent(levelWarn, "Message is due after max_delay, it will be processed early", fields)
+			due = now.Add(q.maxDelay)
+		} else {
+			logEvent(levelDebug, "Delaying message until it is due", fields)
+		}
+	} else {
+		due = now
+	}
+
+	var lane uint32
+	if q.ordered {
+		lane = laneHash(msg, q.batched)
+		for _, held := range q.held {
+			if held.lane == lane && held.due.After(due) {
+				due = held.due
+			}
+		}
+	}
+
+	if !due.After(now) {
+		return false
+	}
+	q.held = append(q.held, delayed{item: item, due: due, lane: lane})
+	return true
+}
+
+// Due removes and returns the held items which are due, in the order
+// they were held.
+func (q *delayQueue) Due() []consumed {
+	now := time.Now()
+	due := []consumed{}
+	held := q.held[:0]
+	for _, d := range q.held {
+		if d.due.After(now) {
+			held = append(held, d)
+			continue
+		}
+		due = append(due, d.item)
+	}
+	q.held = held
+	return due
+}
+
+// Clear drops every held item, which are left unmarked to be consumed
+// again, and returns how many there were.
+func (q *delayQueue) Clear() int {
+	if q == nil {
+		return 0
+	}
+
+	cleared := len(q.held)
+	q.held = nil
+	return cleared
+}
+
+// Full returns true when as many items are held as are allowed.
+func (q *delayQueue) Full() bool {
+	return q != nil && len(q.held) >= maxDelayed
+}
+
+// C returns a channel which receives when the earliest held item is due,
+// or nil when none are held or q is nil.
+func (q *delayQueue) C() <-chan time.Time {
+	if q == nil || len(q.held) == 0 {
+		return nil
+	}
+
+	earliest := q.held[0].due
+	for _, d := range q.held[1:] {
+		if d.due.Before(earliest) {
+			earliest = d.due
+		}
+	}
+
+	if q.timer == nil || !earliest.Equal(q.armed) {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+		q.timer = time.NewTimer(time.Until(earliest))
+		q.armed = earliest
+	}
+	return q.timer.C
+}
@@ -0,0 +1,162 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// delayedItem is a message on orders with its not-before header set to
+// val, or without one when val is empty.
+func delayedItem(offset int64, key, val string) consumed {
+	msg := testMessage(offset)
+	if len(key) > 0 {
+		msg.Key = []byte(key)
+	}
+	if len(val) > 0 {
+		msg.Headers = []*sarama.RecordHeader{{Key: []byte("not-before"), Value: []byte(val)}}
+	}
+	return consumed{msg: msg}
+}
+
+func Test_notBefore(t *testing.T) {
+	cases := []struct {
+		name  string
+		val   string
+		want  time.Time
+		ok    bool
+		isErr bool
+	}{
+		{name: "no header", val: "", ok: false},
+		{name: "RFC3339", val: "2019-03-01T12:30:00Z", want: time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC), ok: true},
+		{name: "RFC3339 with offset", val: "2019-03-01T13:30:00+01:00", want: time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC), ok: true},
+		{name: "milliseconds since the epoch", val: "1551443400250", want: time.Date(2019, 3, 1, 12, 30, 0, 250*int(time.Millisecond), time.UTC), ok: true},
+		{name: "date without a time", val: "2019-03-01", isErr: true},
+		{name: "not a time", val: "tomorrow", isErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			due, ok, err := notBefore(delayedItem(1, "", c.val).msg, "not-before")
+			if (err != nil) != c.isErr {
+				t.Fatalf("want error %t, got %v", c.isErr, err)
+			}
+			if ok != c.ok {
+				t.Fatalf("want ok %t, got %t", c.ok, ok)
+			}
+			if ok && !due.Equal(c.want) {
+				t.Errorf("want %s, got %s", c.want, due)
+			}
+		})
+	}
+}
+
+func Test_delayQueue_HoldsUntilDue(t *testing.T) {
+	q := newDelayQueue("not-before", time.Minute, false, false)
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	soon := strconv.FormatInt(time.Now().Add(200*time.Millisecond).UnixNano()/int64(time.Millisecond), 10)
+
+	if q.Hold(delayedItem(1, "", "")) {
+		t.Fatalf("want a message without the header not held")
+	}
+	if q.Hold(delayedItem(2, "", past)) {
+		t.Fatalf("want a message which is already due not held")
+	}
+	if q.Hold(delayedItem(3, "", "tomorrow")) {
+		t.Fatalf("want a message with an invalid header not held")
+	}
+	if !q.Hold(delayedItem(4, "", soon)) {
+		t.Fatalf("want a message due later held")
+	}
+	if due := q.Due(); len(due) != 0 {
+		t.Fatalf("want nothing due yet, got %d messages", len(due))
+	}
+
+	select {
+	case <-q.C():
+	case <-time.After(time.Second):
+		t.Fatalf("want the timer to fire when the message is due")
+	}
+
+	due := q.Due()
+	if len(due) != 1 || due[0].msg.Offset != 4 {
+		t.Fatalf("want offset 4 due, got %v", due)
+	}
+	if q.C() != nil {
+		t.Fatalf("want no timer once nothing is held")
+	}
+}
+
+func Test_delayQueue_CapsAtMaxDelay(t *testing.T) {
+	q := newDelayQueue("not-before", 20*time.Millisecond, false, false)
+
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	if !q.Hold(delayedItem(1, "", tomorrow)) {
+		t.Fatalf("want a message due tomorrow held")
+	}
+
+	select {
+	case <-q.C():
+	case <-time.After(time.Second):
+		t.Fatalf("want the message due after max_delay")
+	}
+	if due := q.Due(); len(due) != 1 {
+		t.Fatalf("want the message processed early, got %d messages", len(due))
+	}
+}
+
+func Test_delayQueue_KeyOrdering(t *testing.T) {
+	later := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	cases := []struct {
+		name     string
+		ordered  bool
+		sameKey  bool
+		wantHeld bool
+	}{
+		{name: "unordered", ordered: false, sameKey: true, wantHeld: false},
+		{name: "same key is held behind", ordered: true, sameKey: true, wantHeld: true},
+		{name: "other keys are not", ordered: true, sameKey: false, wantHeld: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := newDelayQueue("not-before", time.Hour, c.ordered, false)
+			q.Hold(delayedItem(1, "order-1", later))
+
+			key := "order-2"
+			if c.sameKey {
+				key = "order-1"
+			}
+			if held := q.Hold(delayedItem(2, key, "")); held != c.wantHeld {
+				t.Fatalf("want held %t, got %t", c.wantHeld, held)
+			}
+		})
+	}
+}
+
+func Test_delayQueue_Clear(t *testing.T) {
+	q := newDelayQueue("not-before", time.Hour, false, false)
+	later := time.Now().Add(time.Hour).Format(time.RFC3339)
+	q.Hold(delayedItem(1, "", later))
+	q.Hold(delayedItem(2, "", later))
+
+	if cleared := q.Clear(); cleared != 2 {
+		t.Fatalf("want 2 messages cleared, got %d", cleared)
+	}
+	if q.C() != nil || q.Full() {
+		t.Fatalf("want nothing held once cleared")
+	}
+
+	// Delays are disabled with a nil queue.
+	var disabled *delayQueue
+	if disabled.Hold(delayedItem(3, "", later)) || disabled.C() != nil || disabled.Clear() != 0 {
+		t.Fatalf("want a nil queue to hold nothing")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// messageFilter decides whether a message is relevant to the functions
+// bound to its topic. A filter with no header or path set matches every
+// message.
+type messageFilter struct {
+	Header string
+	Value  string
+
+	// Path is a JSONPath such as $.order.items[0].sku which must
+	// resolve in the message's JSON body, and to PathValue when set.
+	Path      []string
+	PathValue string
+}
+
+// Match reports whether msg passes every configured filter.
+func (f messageFilter) Match(msg *sarama.ConsumerMessage) bool {
+	if len(f.Header) > 0 && !f.matchHeader(msg) {
+		return false
+	}
+
+	if len(f.Path) > 0 && !f.matchPath(msg) {
+		return false
+	}
+
+	return true
+}
+
+func (f messageFilter) matchHeader(msg *sarama.ConsumerMessage) bool {
+	for _, header := range msg.Headers {
+		if header == nil || !strings.EqualFold(string(header.Key), f.Header) {
+			continue
+		}
+		if len(f.Value) == 0 || string(header.Value) == f.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f messageFilter) matchPath(msg *sarama.ConsumerMessage) bool {
+	var body interface{}
+	if err := json.Unmarshal(msg.Value, &body); err != nil {
+		return false
+	}
+
+	value, ok := resolvePath(body, f.Path)
+	if !ok {
+		return false
+	}
+
+	if len(f.PathValue) == 0 {
+		return true
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v == f.PathValue
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64) == f.PathValue
+	case bool:
+		return strconv.FormatBool(v) == f.PathValue
+	}
+	return false
+}
+
+// resolvePath walks the keys and indexes of a parsed JSON document,
+// returning false when any of them is missing or the result is null.
+func resolvePath(value interface{}, path []string) (interface{}, bool) {
+	for _, step := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[step]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, value != nil
+}
+
+// parseJSONPath splits a JSONPath made of dotted keys and array indexes
+// such as $.order.items[0].sku into its steps.
+func parseJSONPath(expression string) ([]string, error) {
+	expression = strings.TrimSpace(expression)
+	if !strings.HasPrefix(expression, "$") {
+		return nil, fmt.Errorf("path must start with $")
+	}
+
+	var path []string
+	for _, part := range strings.Split(strings.TrimPrefix(expression, "$"), ".") {
+		if len(part) == 0 {
+			continue
+		}
+
+		key := part
+		var indexes []string
+		if open := strings.Index(part, "["); open >= 0 {
+			key = part[:open]
+			for _, index := range strings.Split(part[open:], "[") {
+				if len(index) == 0 {
+					continue
+				}
+				if !strings.HasSuffix(index, "]") {
+					return nil, fmt.Errorf("unterminated index in %q", part)
+				}
+				index = strings.TrimSuffix(index, "]")
+				if _, err := strconv.Atoi(index); err != nil {
+					return nil, fmt.Errorf("invalid index %q in %q", index, part)
+				}
+				indexes = append(indexes, index)
+			}
+		}
+
+		if len(key) > 0 {
+			path = append(path, key)
+		}
+		path = append(path, indexes...)
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path has no keys")
+	}
+	return path, nil
+}
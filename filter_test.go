@@ -0,0 +1,150 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func Test_parseJSONPath(t *testing.T) {
+	cases := []struct {
+		expression string
+		path       []string
+	}{
+		{expression: "$.id", path: []string{"id"}},
+		{expression: "$.order.customer.id", path: []string{"order", "customer", "id"}},
+		{expression: "$.order.items[0].sku", path: []string{"order", "items", "0", "sku"}},
+		{expression: "$.matrix[1][2]", path: []string{"matrix", "1", "2"}},
+		{expression: "$[3]", path: []string{"3"}},
+		{expression: " $.id ", path: []string{"id"}},
+	}
+
+	for _, c := range cases {
+		path, err := parseJSONPath(c.expression)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q) unexpected error: %s", c.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(path, c.path) {
+			t.Errorf("parseJSONPath(%q) want %v, got %v", c.expression, c.path, path)
+		}
+	}
+}
+
+func Test_parseJSONPath_Invalid(t *testing.T) {
+	cases := []string{
+		"",
+		"id",
+		"$",
+		"$.",
+		"$.items[0",
+		"$.items[first]",
+		"$.items[-]",
+	}
+
+	for _, expression := range cases {
+		if path, err := parseJSONPath(expression); err == nil {
+			t.Errorf("parseJSONPath(%q) want an error, got %v", expression, path)
+		}
+	}
+}
+
+func Test_messageFilter_MatchPath(t *testing.T) {
+	body := `{"order":{"status":"paid","total":12.5,"count":3,"gift":false,"note":null,"items":[{"sku":"a-1"},{"sku":"b-2"}]}}`
+
+	cases := []struct {
+		name      string
+		path      string
+		pathValue string
+		value     string
+		match     bool
+	}{
+		{name: "key exists", path: "$.order.status", value: body, match: true},
+		{name: "string equals", path: "$.order.status", pathValue: "paid", value: body, match: true},
+		{name: "string differs", path: "$.order.status", pathValue: "refunded", value: body, match: false},
+		{name: "float equals", path: "$.order.total", pathValue: "12.5", value: body, match: true},
+		{name: "integer equals", path: "$.order.count", pathValue: "3", value: body, match: true},
+		{name: "bool equals", path: "$.order.gift", pathValue: "false", value: body, match: true},
+		{name: "array index", path: "$.order.items[1].sku", pathValue: "b-2", value: body, match: true},
+		{name: "object is not compared", path: "$.order", pathValue: "paid", value: body, match: false},
+		{name: "index out of range", path: "$.order.items[2].sku", value: body, match: false},
+		{name: "index into an object", path: "$.order.status[0]", value: body, match: false},
+		{name: "missing field", path: "$.order.refund", value: body, match: false},
+		{name: "missing parent", path: "$.invoice.status", value: body, match: false},
+		{name: "null field", path: "$.order.note", value: body, match: false},
+		{name: "not JSON", path: "$.order.status", value: "status=paid", match: false},
+		{name: "empty value", path: "$.order.status", value: "", match: false},
+		{name: "JSON string", path: "$.order", value: `"order"`, match: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, err := parseJSONPath(c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter := messageFilter{Path: path, PathValue: c.pathValue}
+
+			msg := &sarama.ConsumerMessage{Topic: "orders", Value: []byte(c.value)}
+			if got := filter.Match(msg); got != c.match {
+				t.Errorf("want match %t, got %t", c.match, got)
+			}
+		})
+	}
+}
+
+func Test_messageFilter_MatchHeader(t *testing.T) {
+	headers := []*sarama.RecordHeader{
+		{Key: []byte("Event-Type"), Value: []byte("order.paid")},
+		nil,
+	}
+
+	cases := []struct {
+		name   string
+		filter messageFilter
+		match  bool
+	}{
+		{name: "no filter", filter: messageFilter{}, match: true},
+		{name: "header exists", filter: messageFilter{Header: "event-type"}, match: true},
+		{name: "header equals", filter: messageFilter{Header: "event-type", Value: "order.paid"}, match: true},
+		{name: "header differs", filter: messageFilter{Header: "event-type", Value: "order.refunded"}, match: false},
+		{name: "header missing", filter: messageFilter{Header: "tenant"}, match: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg := &sarama.ConsumerMessage{Topic: "orders", Headers: headers, Value: []byte(`{}`)}
+			if got := c.filter.Match(msg); got != c.match {
+				t.Errorf("want match %t, got %t", c.match, got)
+			}
+		})
+	}
+}
+
+func Test_messageFilter_MatchHeaderAndPath(t *testing.T) {
+	path, _ := parseJSONPath("$.status")
+	filter := messageFilter{Header: "event-type", Value: "order", Path: path, PathValue: "paid"}
+
+	header := []*sarama.RecordHeader{{Key: []byte("event-type"), Value: []byte("order")}}
+	cases := []struct {
+		name    string
+		headers []*sarama.RecordHeader
+		value   string
+		match   bool
+	}{
+		{name: "both match", headers: header, value: `{"status":"paid"}`, match: true},
+		{name: "header missing", value: `{"status":"paid"}`, match: false},
+		{name: "path differs", headers: header, value: `{"status":"new"}`, match: false},
+	}
+
+	for _, c := range cases {
+		msg := &sarama.ConsumerMessage{Topic: "orders", Headers: c.headers, Value: []byte(c.value)}
+		if got := filter.Match(msg); got != c.match {
+			t.Errorf("%s: want match %t, got %t", c.name, c.match, got)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openfaas/faas-provider/auth"
+	"github.com/openfaas/faas/gateway/requests"
+)
+
+// FunctionLookupBuilder builds a map of topics to the OpenFaaS functions
+// which have advertised an interest in them with the topic annotation
+type FunctionLookupBuilder struct {
+	GatewayURL  string
+	Client      *http.Client
+	Credentials *auth.BasicAuthCredentials
+
+	// Namespaces to query for functions, when empty the gateway's
+	// default namespace is used. Functions found in a namespace are
+	// named "function.namespace" so they are invoked in that namespace.
+	Namespaces []string
+
+	// RateLimiters receives the rate limits set by the rate_limit and
+	// rate_burst annotations when it is not nil.
+	RateLimiters *rateLimiters
+
+	// Samplers receives the rates set by the sample_rate annotation
+	// when it is not nil.
+	Samplers *samplers
+
+	// Timeouts receives the timeouts set by the upstream_timeout
+	// annotation when it is not nil.
+	Timeouts *functionTimeouts
+}
+
+// Build compiles a map of topic names and functions that have
+// advertised to receive messages on said topic
+func (s *FunctionLookupBuilder) Build() (map[string][]string, error) {
+	serviceMap := make(map[string][]string)
+	limits := make(map[string]rateLimit)
+	rates := make(map[string]float64)
+	timeouts := make(map[string]time.Duration)
+
+	namespaces := s.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	for _, namespace := range namespaces {
+		if err := s.addFunctions(serviceMap, limits, rates, timeouts, namespace); err != nil {
+			return serviceMap, err
+		}
+	}
+
+	if s.RateLimiters != nil {
+		s.RateLimiters.Sync(limits)
+	}
+	if s.Samplers != nil {
+		s.Samplers.Sync(rates)
+	}
+	if s.Timeouts != nil {
+		s.Timeouts.Sync(timeouts)
+	}
+
+	return serviceMap, nil
+}
+
+func (s *FunctionLookupBuilder) addFunctions(serviceMap map[string][]string, limits map[string]rateLimit, rates map[string]float64, timeouts map[string]time.Duration, namespace string) error {
+	functions, err := s.getFunctions(namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, function := range functions {
+		if function.Annotations == nil {
+			continue
+		}
+		annotations := *function.Annotations
+
+		name := function.Name
+		if len(namespace) > 0 {
+			name = fmt.Sprintf("%s.%s", function.Name, namespace)
+		}
+
+		if topicNames, pass := annotations["topic"]; pass {
+			for _, topic := range strings.Split(topicNames, ",") {
+				topic = strings.TrimSpace(topic)
+				if len(topic) > 0 {
+					serviceMap[topic] = append(serviceMap[topic], name)
+				}
+			}
+		}
+
+		if expression, pass := annotations["topic_regex"]; pass && len(expression) > 0 {
+			topic := regexPrefix + expression
+			serviceMap[topic] = append(serviceMap[topic], name)
+		}
+
+		if s.RateLimiters != nil {
+			if limit, ok := parseRateLimit(annotations, s.RateLimiters.defaultLimit); ok {
+				limits[name] = limit
+			}
+		}
+
+		if s.Samplers != nil {
+			rate, ok, err := parseSampleRate(annotations)
+			if err != nil && s.Samplers.invalid.Allow(name) {
+				logEvent(levelWarn, "Ignoring invalid sample_rate annotation, every message is sent to the function", logFields{
+					"function": name,
+					"error":    err.Error(),
+				})
+			}
+			if ok {
+				rates[name] = rate
+			}
+		}
+
+		if s.Timeouts != nil {
+			if timeout, ok := parseUpstreamTimeout(annotations); ok {
+				timeouts[name] = timeout
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *FunctionLookupBuilder) getFunctions(namespace string) ([]requests.Function, error) {
+	functionsURL := fmt.Sprintf("%s/system/functions", s.GatewayURL)
+	if len(namespace) > 0 {
+		functionsURL = functionsURL + "?namespace=" + url.QueryEscape(namespace)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, functionsURL, nil)
+
+	if s.Credentials != nil {
+		req.SetBasicAuth(s.Credentials.User, s.Credentials.Password)
+	}
+
+	res, reqErr := s.Client.Do(req)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+
+	bytesOut, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &gatewayStatusError{url: functionsURL, status: res.StatusCode}
+	}
+
+	functions := []requests.Function{}
+	if marshalErr := json.Unmarshal(bytesOut, &functions); marshalErr != nil {
+		return nil, marshalErr
+	}
+
+	return functions, nil
+}
+
+// gatewayStatusError is returned when the gateway responds to a lookup
+// with a status other than 200.
+type gatewayStatusError struct {
+	url    string
+	status int
+}
+
+func (e *gatewayStatusError) Error() string {
+	if e.status == http.StatusUnauthorized {
+		return fmt.Sprintf("%s returned status %d, check the gateway credentials", e.url, e.status)
+	}
+	return fmt.Sprintf("%s returned status %d", e.url, e.status)
+}
+
+// beginMapBuilder rebuilds the topic map by querying the gateway for
+// functions every config.RebuildInterval plus up to config.RebuildJitter
+// of it at random. Unless config.SkipGatewayCheck is set the topic map is
+// built once first, retrying while the gateway starts up for up to
+// config.StartupLookupTimeout and exiting if it still can't be queried.
+func beginMapBuilder(config connectorConfig, topicMap *TopicMap, limiters *rateLimiters, sampling *samplers, timeouts *functionTimeouts) {
+	lookupBuilder := FunctionLookupBuilder{
+		GatewayURL:  config.GatewayURL,
+		Client:      makeClient(config.LookupTimeout, config),
+		Credentials: config.Credentials,
+		Namespaces:  config.Namespaces,
+
+		RateLimiters: limiters,
+		Samplers:     sampling,
+		Timeouts:     timeouts,
+	}
+
+	if !config.SkipGatewayCheck {
+		start := time.Now()
+		for attempt := 1; ; attempt++ {
+			lookups, err := lookupBuilder.Build()
+			if err == nil {
+				topicMap.Sync(&lookups)
+				break
+			}
+
+			// Rejected credentials won't be fixed by waiting.
+			statusErr, ok := err.(*gatewayStatusError)
+			unauthorized := ok && statusErr.status == http.StatusUnauthorized
+			if unauthorized || time.Since(start) >= config.StartupLookupTimeout {
+				log.Fatalf("Unable to list functions from the gateway at %s, set skip_gateway_check=true to start without checking: %s", config.GatewayURL, err)
+			}
+
+			delay := connectDelay(attempt, config.ConnectMaxInterval)
+			logEvent(levelWarn, "Gateway is not available yet, retrying", logFields{
+				"attempt": attempt,
+				"delay":   delay.String(),
+				"error":   err.Error(),
+			})
+			time.Sleep(delay)
+		}
+	}
+
+	go synchronizeLookups(config.RebuildInterval, config.RebuildJitter, &lookupBuilder, topicMap, config.MaxLookupFailures)
+}
+
+// jitteredInterval returns interval lengthened by a random amount of up
+// to jitter times interval, so it is never shorter than interval and at
+// most double it.
+func jitteredInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || interval <= 0 {
+		return interval
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return interval + time.Duration(rand.Float64()*jitter*float64(interval))
+}
+
+// synchronizeLookups rebuilds the topic map after each jittered interval.
+// When a rebuild fails the last topic map is kept, the connector only
+// exits once maxFailures consecutive rebuilds have failed, or never if it is 0.
+func synchronizeLookups(interval time.Duration,
+	jitter float64,
+	lookupBuilder *FunctionLookupBuilder,
+	topicMap *TopicMap,
+	maxFailures int) {
+
+	failures := 0
+
+	for {
+		time.Sleep(jitteredInterval(interval, jitter))
+		lookups, err := lookupBuilder.Build()
+		if err != nil {
+			failures++
+			if maxFailures > 0 && failures >= maxFailures {
+				log.Fatalf("Unable to build topic map after %d attempts: %s", failures, err)
+			}
+
+			logEvent(levelWarn, "Unable to build topic map, keeping the last one", logFields{
+				"failures": failures,
+				"error":    err.Error(),
+			})
+			continue
+		}
+		failures = 0
+
+		logEvent(levelDebug, "Syncing topic map", nil)
+		topicMap.Sync(&lookups)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// ready is set to 1 once the Kafka consumer has been created and back
+// to 0 when the connector begins to shut down.
+var ready int32
+
+func setReady(value bool) {
+	if value {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// paused is set to 1 while consumption has been paused through the
+// /pause endpoint, pauseChanged wakes the consume loop when it changes.
+var (
+	paused       int32
+	pauseChanged = make(chan struct{}, 1)
+)
+
+func setPaused(value bool) {
+	if value {
+		atomic.StoreInt32(&paused, 1)
+	} else {
+		atomic.StoreInt32(&paused, 0)
+	}
+
+	select {
+	case pauseChanged <- struct{}{}:
+	default:
+	}
+}
+
+func isPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+// startHealthServer serves /healthz on the given address and port in the
+// background, on every interface when address is empty, returning 200
+// when the consumer is ready and 503 otherwise. A POST to /pause or
+// /resume pauses or resumes consumption and /topicmap returns the
+// functions bound to each topic as JSON.
+func startHealthServer(address string, port int, topicMap *TopicMap) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if isPaused() {
+			w.Write([]byte("OK, paused"))
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+
+	mux.HandleFunc("/pause", pauseHandler(true))
+	mux.HandleFunc("/resume", pauseHandler(false))
+
+	mux.HandleFunc("/topicmap", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(topicMap.Snapshot())
+	})
+
+	s := &http.Server{
+		Addr:    net.JoinHostPort(address, strconv.Itoa(port)),
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Serving health checks on %s", s.Addr)
+		if err := s.ListenAndServe(); err != nil {
+			log.Fatalf("Unable to serve health checks: %s", err)
+		}
+	}()
+}
+
+func pauseHandler(value bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if value != isPaused() {
+			setPaused(value)
+			if value {
+				log.Printf("Consumption paused")
+			} else {
+				log.Printf("Consumption resumed")
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+	"github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/pkg/errors"
+)
+
+// invokeFunction calls a function through the gateway with the message
+// value as the body. Transport errors and 5xx responses are retried with
+// exponential backoff up to config.MaxRetries times, other statuses are
+// returned straight away. A 429 means the function is at capacity, such
+// as while it scales from zero, so it is retried after its Retry-After
+// or with backoff for up to config.ThrottleTimeout without counting as a
+// retry. Each attempt waits for the function's rate limit. The
+// invocation, including its retries, is traced as one span when tracing
+// is enabled. When msg is a batch, batch is the number of messages it
+// holds, otherwise it is 0.
+func invokeFunction(c *http.Client, limiters *rateLimiters, config connectorConfig, function string, msg *sarama.ConsumerMessage, batch int) types.InvokerResponse {
+	var res types.InvokerResponse
+
+	span := startSpan(msg, function)
+
+	throttled := 0
+	throttleDeadline := time.Now().Add(config.ThrottleTimeout)
+
+	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(config.RetryInitialInterval, attempt)
+			logEvent(levelWarn, "Retrying function", logFields{
+				"function":    function,
+				"delay":       delay.String(),
+				"attempt":     attempt,
+				"max_retries": config.MaxRetries,
+			})
+			time.Sleep(delay)
+		}
+
+		res = invokeOnce(c, limiters, config, function, msg, batch, span)
+		for res.Status == http.StatusTooManyRequests {
+			throttledInvocations.WithLabelValues(function).Inc()
+			throttled++
+
+			delay := retryAfter(res, retryDelay(config.RetryInitialInterval, throttled))
+			if time.Now().Add(delay).After(throttleDeadline) {
+				break
+			}
+
+			logEvent(levelWarn, "Function is at capacity, retrying", logFields{
+				"function":  function,
+				"delay":     delay.String(),
+				"throttled": throttled,
+			})
+			time.Sleep(delay)
+			res = invokeOnce(c, limiters, config, function, msg, batch, span)
+		}
+
+		if res.Error == nil && (res.Status < http.StatusInternalServerError || config.SuccessStatusCodes.Match(res.Status)) {
+			break
+		}
+	}
+
+	failure := res.Error
+	if failure == nil && !config.SuccessStatusCodes.Match(res.Status) {
+		failure = fmt.Errorf("%s returned status %d", function, res.Status)
+	}
+	span.End(res.Status, failure)
+
+	return res
+}
+
+func invokeOnce(c *http.Client, limiters *rateLimiters, config connectorConfig, function string, msg *sarama.ConsumerMessage, batch int, span *span) types.InvokerResponse {
+	gwURL := config.GatewayURL + invokePath(config.InvokePathTemplate, function)
+
+	// A request and body are built for every function and attempt as a
+	// reader can only be consumed once, and closed when this returns.
+	var reqBody io.Reader
+	compressed := false
+	if config.InvokeMethod != http.MethodGet {
+		reqBody = bytes.NewReader(msg.Value)
+		if config.CompressRequest {
+			gzipped, err := gzipBody(msg.Value)
+			if err != nil {
+				return types.InvokerResponse{
+					Error:    errors.Wrap(err, fmt.Sprintf("unable to compress the request to %s", function)),
+					Status:   http.StatusServiceUnavailable,
+					Function: function,
+					Topic:    msg.Topic,
+				}
+			}
+			reqBody = bytes.NewReader(gzipped)
+			compressed = true
+		}
+	}
+	httpReq, _ := http.NewRequest(config.InvokeMethod, gwURL, reqBody)
+	if batch > 0 {
+		addBatchHeaders(httpReq, config, msg, batch)
+	} else {
+		addHeaders(httpReq, config, msg)
+	}
+	for name, value := range config.InvokeHeaders {
+		httpReq.Header.Set(name, value)
+	}
+	if compressed {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	injectTraceContext(httpReq, msg, span)
+
+	// The timeout bounds the whole request including reading the body,
+	// not only the dial, so a function which never responds is abandoned.
+	ctx, cancel := context.WithTimeout(context.Background(), config.UpstreamTimeout)
+	defer cancel()
+	httpReq = httpReq.WithContext(ctx)
+
+	if err := limiters.Wait(ctx, function); err != nil {
+		return types.InvokerResponse{
+			Error:    errors.Wrap(err, fmt.Sprintf("rate limit for %s was not available within %s", function, config.UpstreamTimeout)),
+			Status:   http.StatusTooManyRequests,
+			Function: function,
+			Topic:    msg.Topic,
+		}
+	}
+
+	if config.Credentials != nil {
+		httpReq.SetBasicAuth(config.Credentials.User, config.Credentials.Password)
+	}
+
+	res, doErr := c.Do(httpReq)
+	if doErr != nil {
+		return types.InvokerResponse{
+			Error:    errors.Wrap(doErr, fmt.Sprintf("unable to invoke %s", function)),
+			Status:   http.StatusServiceUnavailable,
+			Function: function,
+			Topic:    msg.Topic,
+		}
+	}
+
+	var body []byte
+	if res.Body != nil {
+		defer res.Body.Close()
+
+		// One byte more than the limit is read to tell when it's exceeded.
+		bytesOut, readErr := ioutil.ReadAll(io.LimitReader(res.Body, config.MaxResponseBytes+1))
+		if readErr == nil && int64(len(bytesOut)) > config.MaxResponseBytes {
+			readErr = fmt.Errorf("response exceeds max_response_bytes of %d", config.MaxResponseBytes)
+		}
+		if readErr != nil {
+			return types.InvokerResponse{
+				Error:    errors.Wrap(readErr, fmt.Sprintf("unable to read response from %s", function)),
+				Status:   http.StatusServiceUnavailable,
+				Function: function,
+				Topic:    msg.Topic,
+			}
+		}
+		body = bytesOut
+	}
+
+	return types.InvokerResponse{
+		Body:     &body,
+		Header:   &res.Header,
+		Status:   res.StatusCode,
+		Function: function,
+		Topic:    msg.Topic,
+	}
+}
+
+// gzipBody compresses the body of an invocation.
+func gzipBody(body []byte) ([]byte, error) {
+	compressed := bytes.Buffer{}
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// invokePath fills in the {name} and {namespace} placeholders of the
+// template for a function. Functions looked up in a namespace are named
+// "function.namespace", when the template has a {namespace} placeholder
+// {name} is only the function's name, otherwise it is the whole name.
+func invokePath(template string, function string) string {
+	name := function
+	namespace := ""
+	if strings.Contains(template, "{namespace}") {
+		if i := strings.Index(function, "."); i >= 0 {
+			name = function[:i]
+			namespace = function[i+1:]
+		}
+	}
+
+	return strings.NewReplacer("{name}", name, "{namespace}", namespace).Replace(template)
+}
+
+// addHeaders sets the headers on a function invocation which describe
+// the message being delivered.
+func addHeaders(httpReq *http.Request, config connectorConfig, msg *sarama.ConsumerMessage) {
+	contentType := config.ContentType
+	if val, ok := config.ContentTypeMap[msg.Topic]; ok {
+		contentType = val
+	}
+	if len(config.ContentTypeHeader) > 0 {
+		if val := recordHeader(msg, config.ContentTypeHeader); len(val) > 0 {
+			contentType = sanitizeHeaderValue(val)
+		}
+	}
+	if config.Envelope {
+		contentType = "application/json"
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+
+	httpReq.Header.Set("X-Topic", msg.Topic)
+	httpReq.Header.Set("X-Partition", strconv.Itoa(int(msg.Partition)))
+	httpReq.Header.Set("X-Offset", strconv.FormatInt(msg.Offset, 10))
+	if !msg.Timestamp.IsZero() {
+		httpReq.Header.Set("X-Message-Timestamp", msg.Timestamp.Format(time.RFC3339))
+	}
+	if len(msg.Value) == 0 {
+		httpReq.Header.Set("X-Kafka-Tombstone", "true")
+	}
+
+	if config.ForwardKey && msg.Key != nil {
+		if utf8.Valid(msg.Key) {
+			httpReq.Header.Set("X-Kafka-Key", string(msg.Key))
+		} else {
+			httpReq.Header.Set("X-Kafka-Key", base64.StdEncoding.EncodeToString(msg.Key))
+			httpReq.Header.Set("X-Kafka-Key-Encoding", "base64")
+		}
+	}
+
+	for _, header := range msg.Headers {
+		// The content type header is already the Content-Type.
+		if len(config.ContentTypeHeader) > 0 && strings.EqualFold(string(header.Key), config.ContentTypeHeader) {
+			continue
+		}
+
+		name := sanitizeHeaderName(config.HeaderPrefix + string(header.Key))
+		if len(name) == 0 || reservedHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		httpReq.Header.Add(name, sanitizeHeaderValue(string(header.Value)))
+	}
+}
+
+// addBatchHeaders sets the headers on the invocation of a batch, the
+// headers of its messages are not forwarded as they can differ.
+func addBatchHeaders(httpReq *http.Request, config connectorConfig, msg *sarama.ConsumerMessage, batch int) {
+	if config.BatchFormat == "ndjson" {
+		httpReq.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	httpReq.Header.Set("X-Topic", msg.Topic)
+	httpReq.Header.Set("X-Batch-Size", strconv.Itoa(batch))
+}
+
+// reservedHeaders are set by the HTTP client and must not be
+// overridden by Kafka record headers.
+var reservedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// sanitizeHeaderName replaces any characters which are not valid in
+// an HTTP header name with a hyphen.
+func sanitizeHeaderName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// sanitizeHeaderValue strips characters which would allow a header
+// value to break out onto a new line.
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// maxRetryBackoff caps the backoff between retries, unless the initial
+// interval is already longer, so long runs of retries don't overflow.
+const maxRetryBackoff = time.Minute
+
+// minRetryAfter is the shortest delay taken from a Retry-After header,
+// so a gateway which answers with 0 or a past date isn't retried in a
+// tight loop.
+const minRetryAfter = time.Second
+
+// retryDelay returns the exponential backoff before the given retry
+// attempt, starting at 1, with jitter of up to half of the backoff.
+func retryDelay(initial time.Duration, attempt int) time.Duration {
+	backoff := initial
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if initial < maxRetryBackoff && backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	return backoff/2 + jitter
+}
+
+// retryAfter returns the delay given by the Retry-After header of res,
+// either in seconds or as an HTTP date and at least minRetryAfter, or
+// backoff when it has none.
+func retryAfter(res types.InvokerResponse, backoff time.Duration) time.Duration {
+	if res.Header == nil {
+		return backoff
+	}
+
+	val := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+		return atLeast(time.Duration(seconds)*time.Second, minRetryAfter)
+	}
+	if date, err := http.ParseTime(val); err == nil {
+		return atLeast(time.Until(date), minRetryAfter)
+	}
+	return backoff
+}
+
+func atLeast(delay, min time.Duration) time.Duration {
+	if delay < min {
+		return min
+	}
+	return delay
+}
+
+// statusCodes are the HTTP statuses which mean a message was processed,
+// or for asynchronous invocations that it was accepted with a 202.
+type statusCodes []statusRange
+
+type statusRange struct {
+	From int
+	To   int
+}
+
+// defaultSuccessCodes are the statuses which are a success unless
+// success_status_codes is set.
+var defaultSuccessCodes = statusCodes{{From: 200, To: 299}}
+
+// Match reports whether status is one of the codes.
+func (s statusCodes) Match(status int) bool {
+	for _, r := range s {
+		if status >= r.From && status <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusCodes parses a comma-separated list of HTTP statuses and
+// inclusive ranges of them such as "200-299,304".
+func parseStatusCodes(val string) (statusCodes, error) {
+	codes := statusCodes{}
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+
+		r := statusRange{}
+		var err error
+		if r.From, err = strconv.Atoi(from); err != nil {
+			return nil, fmt.Errorf("invalid status %q", from)
+		}
+		if r.To, err = strconv.Atoi(to); err != nil {
+			return nil, fmt.Errorf("invalid status %q", to)
+		}
+		if r.From < 100 || r.To > 599 || r.From > r.To {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		codes = append(codes, r)
+	}
+
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no statuses given")
+	}
+	return codes, nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openfaas-incubator/connector-sdk/types"
+)
+
+func Test_parseStatusCodes(t *testing.T) {
+	cases := []struct {
+		name    string
+		val     string
+		match   []int
+		noMatch []int
+	}{
+		{
+			name:    "range",
+			val:     "200-299",
+			match:   []int{200, 250, 299},
+			noMatch: []int{199, 300, 404},
+		},
+		{
+			name:    "explicit code",
+			val:     "204",
+			match:   []int{204},
+			noMatch: []int{200, 203, 205},
+		},
+		{
+			name:    "mixed list",
+			val:     "200-202, 204,304 ,400 - 404",
+			match:   []int{200, 202, 204, 304, 400, 404},
+			noMatch: []int{203, 205, 303, 399, 405, 500},
+		},
+		{
+			name:    "empty entries are skipped",
+			val:     "200,,201,",
+			match:   []int{200, 201},
+			noMatch: []int{202},
+		},
+		{
+			name:  "bounds",
+			val:   "100-599",
+			match: []int{100, 599},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			codes, err := parseStatusCodes(c.val)
+			if err != nil {
+				t.Fatalf("parseStatusCodes(%q) unexpected error: %s", c.val, err)
+			}
+			for _, status := range c.match {
+				if !codes.Match(status) {
+					t.Errorf("%q should match %d", c.val, status)
+				}
+			}
+			for _, status := range c.noMatch {
+				if codes.Match(status) {
+					t.Errorf("%q should not match %d", c.val, status)
+				}
+			}
+		})
+	}
+}
+
+func Test_parseStatusCodes_Invalid(t *testing.T) {
+	cases := []string{
+		"",
+		",",
+		"ok",
+		"200-",
+		"-299",
+		"2xx",
+		"99",
+		"600",
+		"200-600",
+		"299-200",
+		"200,abc",
+	}
+
+	for _, val := range cases {
+		if codes, err := parseStatusCodes(val); err == nil {
+			t.Errorf("parseStatusCodes(%q) want an error, got %v", val, codes)
+		}
+	}
+}
+
+func Test_defaultSuccessCodes(t *testing.T) {
+	if !defaultSuccessCodes.Match(200) || !defaultSuccessCodes.Match(299) {
+		t.Errorf("want 2xx statuses to be a success by default")
+	}
+	if defaultSuccessCodes.Match(300) || defaultSuccessCodes.Match(429) {
+		t.Errorf("want only 2xx statuses to be a success by default")
+	}
+}
+
+func Test_retryDelay_LongRuns(t *testing.T) {
+	for _, initial := range []time.Duration{time.Millisecond, time.Second, 30 * time.Second} {
+		for attempt := 1; attempt <= 1000; attempt++ {
+			delay := retryDelay(initial, attempt)
+			if delay <= 0 || delay > maxRetryBackoff {
+				t.Fatalf("retryDelay(%s, %d) want a delay up to %s, got %s", initial, attempt, maxRetryBackoff, delay)
+			}
+		}
+	}
+}
+
+func Test_retryDelay_Backoff(t *testing.T) {
+	cases := []struct {
+		initial time.Duration
+		attempt int
+		backoff time.Duration
+	}{
+		{initial: time.Second, attempt: 1, backoff: time.Second},
+		{initial: time.Second, attempt: 2, backoff: 2 * time.Second},
+		{initial: time.Second, attempt: 4, backoff: 8 * time.Second},
+		{initial: time.Second, attempt: 35, backoff: maxRetryBackoff},
+		{initial: 2 * time.Minute, attempt: 3, backoff: 2 * time.Minute},
+	}
+
+	for _, c := range cases {
+		delay := retryDelay(c.initial, c.attempt)
+		if delay < c.backoff/2 || delay > c.backoff {
+			t.Errorf("retryDelay(%s, %d) want between %s and %s, got %s", c.initial, c.attempt, c.backoff/2, c.backoff, delay)
+		}
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	cases := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{name: "seconds", retryAfter: "5", want: 5 * time.Second},
+		{name: "zero", retryAfter: "0", want: minRetryAfter},
+		{name: "past date", retryAfter: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), want: minRetryAfter},
+		{name: "missing", retryAfter: "", want: 3 * time.Second},
+		{name: "invalid", retryAfter: "soon", want: 3 * time.Second},
+		{name: "negative", retryAfter: "-1", want: 3 * time.Second},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := http.Header{}
+			if len(c.retryAfter) > 0 {
+				header.Set("Retry-After", c.retryAfter)
+			}
+			res := types.InvokerResponse{Header: &header, Status: http.StatusTooManyRequests}
+
+			if got := retryAfter(res, 3*time.Second); got != c.want {
+				t.Errorf("want %s, got %s", c.want, got)
+			}
+		})
+	}
+}
+
+func Test_invokeFunction_RetryAfterZeroIsNotATightLoop(t *testing.T) {
+	requests := 0
+	lock := sync.Mutex{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer gateway.Close()
+
+	config := testConfig(map[string]string{
+		"gateway_url":      gateway.URL,
+		"throttle_timeout": "1500ms",
+	})
+
+	res := invokeFunction(makeClient(time.Second, config), newRateLimiters(config.RateLimit), config, "billing", testMessage(1), 0)
+
+	if res.Status != http.StatusTooManyRequests {
+		t.Fatalf("want the 429 returned once throttle_timeout is reached, got %d", res.Status)
+	}
+
+	// The first retry waits minRetryAfter, the second would pass the
+	// throttle timeout so the invocation gives up.
+	if requests != 2 {
+		t.Fatalf("want 2 requests within throttle_timeout, got %d", requests)
+	}
+}
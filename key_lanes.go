@@ -0,0 +1,67 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/Shopify/sarama"
+)
+
+// keyLanes processes work on a fixed set of workers, each working through
+// its lane in order. Messages with the same key always use the same lane
+// so they are processed one after another, while different keys are
+// processed concurrently.
+type keyLanes struct {
+	lanes   []chan []consumed
+	batched bool
+}
+
+// newKeyLanes starts n workers which call process for the work sent to
+// their lane. Each lane buffers up to n items so sending never blocks
+// while no more than n items are in flight.
+func newKeyLanes(n int, batched bool, process func(items []consumed)) *keyLanes {
+	l := &keyLanes{
+		lanes:   make([]chan []consumed, n),
+		batched: batched,
+	}
+	for i := range l.lanes {
+		lane := make(chan []consumed, n)
+		l.lanes[i] = lane
+		go func() {
+			for items := range lane {
+				process(items)
+			}
+		}()
+	}
+	return l
+}
+
+// Run sends items to the lane for their key. Batches mix keys but only
+// hold one topic, so they are laned by topic.
+func (l *keyLanes) Run(items []consumed) {
+	l.lanes[laneHash(items[0].msg, l.batched)%uint32(len(l.lanes))] <- items
+}
+
+// laneHash hashes the topic with the key of the message, or its
+// partition when it has no key so keyless messages keep partition order.
+func laneHash(msg *sarama.ConsumerMessage, topicOnly bool) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic))
+	if topicOnly {
+		return h.Sum32()
+	}
+
+	if len(msg.Key) > 0 {
+		h.Write([]byte{0})
+		h.Write(msg.Key)
+	} else {
+		partition := make([]byte, 5)
+		partition[0] = 1
+		binary.BigEndian.PutUint32(partition[1:], uint32(msg.Partition))
+		h.Write(partition)
+	}
+	return h.Sum32()
+}
@@ -0,0 +1,119 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func keyedItem(key string, offset int64) []consumed {
+	return []consumed{{msg: &sarama.ConsumerMessage{Topic: "orders", Key: []byte(key), Offset: offset}}}
+}
+
+// Test_keyLanes_SameKeyInOrder is meant to be run with -race.
+func Test_keyLanes_SameKeyInOrder(t *testing.T) {
+	lock := sync.Mutex{}
+	active := map[string]int{}
+	processed := map[string][]int64{}
+	wg := sync.WaitGroup{}
+
+	lanes := newKeyLanes(4, false, func(items []consumed) {
+		defer wg.Done()
+		key := string(items[0].msg.Key)
+
+		lock.Lock()
+		active[key]++
+		if active[key] > 1 {
+			t.Errorf("want messages with key %s processed one at a time", key)
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		active[key]--
+		processed[key] = append(processed[key], items[0].msg.Offset)
+		lock.Unlock()
+	})
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for offset := int64(0); offset < 20; offset++ {
+		wg.Add(1)
+		lanes.Run(keyedItem(keys[offset%int64(len(keys))], offset))
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		offsets := processed[key]
+		if len(offsets) != 4 {
+			t.Fatalf("want 4 messages processed for key %s, got %v", key, offsets)
+		}
+		for j, offset := range offsets {
+			if want := int64(i + j*len(keys)); offset != want {
+				t.Errorf("want key %s processed in order, got %v", key, offsets)
+				break
+			}
+		}
+	}
+}
+
+func Test_keyLanes_DifferentKeysConcurrently(t *testing.T) {
+	const n = 4
+
+	// Two keys which are hashed to different lanes.
+	first := "key-0"
+	second := ""
+	for i := 1; len(second) == 0; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if laneHash(keyedItem(key, 0)[0].msg, false)%n != laneHash(keyedItem(first, 0)[0].msg, false)%n {
+			second = key
+		}
+	}
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	lanes := newKeyLanes(n, false, func(items []consumed) {
+		started <- string(items[0].msg.Key)
+		<-release
+	})
+	defer close(release)
+
+	lanes.Run(keyedItem(first, 0))
+	lanes.Run(keyedItem(second, 1))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("want messages with different keys processed at once")
+		}
+	}
+}
+
+func Test_laneHash(t *testing.T) {
+	msg := func(key string, partition int32) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Topic: "orders", Key: []byte(key), Partition: partition}
+	}
+
+	if laneHash(msg("a", 0), false) != laneHash(msg("a", 3), false) {
+		t.Errorf("want a key hashed the same on every partition")
+	}
+	if laneHash(msg("", 1), false) == laneHash(msg("", 2), false) {
+		t.Errorf("want keyless messages hashed by partition")
+	}
+	if laneHash(msg("a", 0), true) != laneHash(msg("b", 1), true) {
+		t.Errorf("want batches hashed by topic only")
+	}
+
+	other := msg("a", 0)
+	other.Topic = "payments"
+	if laneHash(msg("a", 0), false) == laneHash(other, false) {
+		t.Errorf("want the same key on different topics hashed apart")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// startLagMonitor reports the lag of the partitions owned by consumer
+// every interval until the returned function is called. Lag is the
+// difference between a partition's high-water mark and the group's
+// committed offset, partitions without a committed offset are skipped.
+func startLagMonitor(client sarama.Client, group string, consumer groupConsumer, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		reported := map[string]map[int32]bool{}
+		for {
+			select {
+			case <-done:
+				// The partitions may be given to another consumer so
+				// their lag is no longer reported from here.
+				clearLag(reported, nil)
+				return
+			case <-ticker.C:
+				reported = reportLag(client, group, consumer.Subscriptions(), reported)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func reportLag(client sarama.Client, group string, owned map[string][]int32, reported map[string]map[int32]bool) map[string]map[int32]bool {
+	req := &sarama.OffsetFetchRequest{
+		Version:       1,
+		ConsumerGroup: group,
+	}
+	for topic, partitions := range owned {
+		for _, partition := range partitions {
+			req.AddPartition(topic, partition)
+		}
+	}
+
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		logEvent(levelWarn, "Unable to fetch committed offsets for consumer lag", logFields{"error": err.Error()})
+		return reported
+	}
+
+	res, err := coordinator.FetchOffset(req)
+	if err != nil {
+		logEvent(levelWarn, "Unable to fetch committed offsets for consumer lag", logFields{"error": err.Error()})
+		return reported
+	}
+
+	current := map[string]map[int32]bool{}
+	for topic, partitions := range owned {
+		for _, partition := range partitions {
+			block := res.GetBlock(topic, partition)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				continue
+			}
+
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				continue
+			}
+
+			lag := newest - block.Offset
+			if lag < 0 {
+				lag = 0
+			}
+			consumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+
+			if current[topic] == nil {
+				current[topic] = map[int32]bool{}
+			}
+			current[topic][partition] = true
+		}
+	}
+
+	clearLag(reported, current)
+	return current
+}
+
+// clearLag removes the lag reported for partitions which are not in
+// current, such as those reassigned to another consumer in the group.
+func clearLag(reported, current map[string]map[int32]bool) {
+	for topic, partitions := range reported {
+		for partition := range partitions {
+			if !current[topic][partition] {
+				consumerLag.DeleteLabelValues(topic, strconv.Itoa(int(partition)))
+			}
+		}
+	}
+}
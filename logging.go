@@ -0,0 +1,194 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFields are the structured properties of a log entry
+type logFields map[string]interface{}
+
+// logLevel is the severity of an entry logged with logEvent
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// parseLogLevel returns the level with the given name, or false when
+// there is none.
+func parseLogLevel(name string) (logLevel, bool) {
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, true
+		}
+	}
+	return levelInfo, false
+}
+
+var (
+	logJSON  bool
+	minLevel           = levelInfo
+	logOut   io.Writer = os.Stderr
+	logLock  sync.Mutex
+
+	// invocationOut receives the lines written by logInvocation, apart
+	// from the other logs so they can be collected on their own.
+	invocationOut io.Writer = os.Stdout
+)
+
+// configureLogging sets the format of the connector's logs, either
+// "text" or "json", and the lowest level logged by logEvent. In JSON
+// mode every line written through the log package becomes an entry
+// with a "time" and "msg" property.
+func configureLogging(format string, level logLevel) {
+	minLevel = level
+
+	if format != "json" {
+		return
+	}
+
+	logJSON = true
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+}
+
+// logEvent logs msg along with its fields, as properties of the entry
+// in JSON mode or as sorted key=value pairs otherwise. Entries below the
+// configured level are dropped.
+func logEvent(level logLevel, msg string, fields logFields) {
+	if level < minLevel {
+		return
+	}
+
+	if logJSON {
+		entry := make(logFields, len(fields)+1)
+		for key, value := range fields {
+			entry[key] = value
+		}
+		entry["level"] = level.String()
+
+		writeJSON(msg, entry)
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, fields[key]))
+	}
+
+	log.Printf("%s %s", msg, strings.Join(pairs, " "))
+}
+
+func writeJSON(msg string, fields logFields) {
+	entry := make(logFields, len(fields)+2)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+
+	out, err := json.Marshal(entry)
+	if err != nil {
+		out, _ = json.Marshal(logFields{"time": entry["time"], "msg": msg, "error": err.Error()})
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOut.Write(append(out, '\n'))
+}
+
+// logInvocation writes status as a line with the same fields in the same
+// order every time, so metrics can be derived from the logs. It is
+// written whatever the log level, in JSON in JSON mode and as key=value
+// pairs otherwise, where the error is left out.
+func logInvocation(status invocationStatus) {
+	var line []byte
+	if logJSON {
+		entry := struct {
+			Event string `json:"event"`
+			invocationStatus
+		}{"invocation", status}
+
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return
+		}
+	} else {
+		line = []byte(fmt.Sprintf("time=%s event=invocation function=%s topic=%s partition=%d offset=%d batch_size=%d status=%d latency_ms=%d success=%t",
+			status.Time.UTC().Format(time.RFC3339Nano), status.Function, status.Topic, status.Partition, status.Offset,
+			status.BatchSize, status.Status, status.LatencyMs, status.Success))
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	invocationOut.Write(append(line, '\n'))
+}
+
+// jsonLogWriter turns the lines written by the log package into JSON
+// entries so free-text logs can be parsed alongside logEvent's.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSON(strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// logThrottle limits how often an entry is logged for each key, such as
+// a warning which would otherwise be logged for every message.
+type logThrottle struct {
+	interval time.Duration
+	last     map[string]time.Time
+	lock     sync.Mutex
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// Allow reports whether an entry for key may be logged now, it is
+// allowed at most once per interval.
+func (t *logThrottle) Allow(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
@@ -5,173 +5,2289 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/Shopify/sarama"
 	cluster "github.com/bsm/sarama-cluster"
 	"github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas/faas-provider/auth"
 )
 
 var saramaKafkaProtocolVersion = sarama.V0_10_2_0
 
+// clientIDPattern matches the client IDs accepted by Sarama.
+var clientIDPattern = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+
 type connectorConfig struct {
 	*types.ControllerConfig
-	Topics []string
-	Broker string
+	Credentials *auth.BasicAuthCredentials
+	Topics      []string
+	Namespaces  []string
+
+	// PrintMessageBody logs the value of each message received
+	PrintMessageBody bool
+
+	// ProcessEmpty invokes functions for messages with an empty value
+	// such as tombstones, which are otherwise skipped
+	ProcessEmpty bool
+
+	// Clusters are consumed from as well as Brokers
+	Clusters []clusterConfig
+
+	// TopicGroups are the consumer groups of topics which are not
+	// consumed with Group
+	TopicGroups map[string]string
+
+	// TopicPattern subscribes to every topic it matches as well as
+	// Topics, the brokers are checked for new topics every
+	// TopicRefreshInterval
+	TopicPattern         *regexp.Regexp
+	TopicRefreshInterval time.Duration
+
+	// DynamicTopics subscribes to the topics in the topic map as well
+	// as Topics, following it as functions are deployed and removed
+	DynamicTopics bool
+
+	// StaticTopicMap binds functions to topics instead of looking them
+	// up from the gateway when it is not empty
+	StaticTopicMap map[string][]string
+
+	// LookupTimeout bounds the requests made to the gateway to build
+	// the topic map, invocations use UpstreamTimeout
+	LookupTimeout time.Duration
+
+	// RebuildJitter is the fraction of RebuildInterval added at random
+	// to each wait between rebuilds, so replicas don't query the
+	// gateway in lockstep
+	RebuildJitter float64
+
+	// SkipGatewayCheck starts without first checking the functions can
+	// be listed from the gateway, which is retried for up to
+	// StartupLookupTimeout
+	SkipGatewayCheck     bool
+	StartupLookupTimeout time.Duration
+
+	// MaxLookupFailures is how many consecutive topic map rebuilds
+	// may fail before exiting, 0 retries forever
+	MaxLookupFailures int
+	Brokers           []string
+	Group             string
+
+	// ConsumerInstances is how many consumers join each consumer group
+	// from this process, sharing the group's partitions between them
+	ConsumerInstances int
+
+	// ClientID identifies the connector's connections to the brokers
+	ClientID string
+
+	SASLUser        string
+	SASLPassword    string
+	SASLMechanism   string
+	TLS             *tls.Config
+	KafkaVersion    sarama.KafkaVersion
+	InitialOffset   int64
+	AtLeastOnce     bool
+	ShutdownTimeout time.Duration
+
+	// DrainTimeout is how long in-flight messages are waited for on
+	// shutdown before they are abandoned and the offsets of those which
+	// completed are committed, 0 waits until ShutdownTimeout
+	DrainTimeout time.Duration
+
+	// CommitInterval is how often marked offsets are committed, unless
+	// ManualCommit is set when they are committed after each message or
+	// batch is processed
+	CommitInterval time.Duration
+	ManualCommit   bool
+
+	// ConnectTimeout is how long to wait for the brokers before
+	// exiting, 0 waits forever
+	ConnectTimeout     time.Duration
+	ConnectMaxInterval time.Duration
+
+	// SASLPasswordFile and the broker TLS files are read again on
+	// SIGHUP to pick up rotated secrets
+	SASLPasswordFile string
+	BrokerCAFile     string
+	BrokerCertFile   string
+	BrokerKeyFile    string
+
+	SessionTimeout    time.Duration
+	HeartbeatInterval time.Duration
+	RebalanceStrategy cluster.Strategy
+
+	// MaxProcessingTime is how long a message may take to be processed
+	// before the partition stops being read ahead
+	MaxProcessingTime time.Duration
+
+	// FetchMinBytes, FetchDefaultBytes and FetchMaxBytes size the
+	// requests to fetch messages, the brokers wait up to FetchMaxWait
+	// for FetchMinBytes to be available
+	FetchMinBytes     int32
+	FetchDefaultBytes int32
+	FetchMaxBytes     int32
+	FetchMaxWait      time.Duration
+
+	// IsolationLevel is ReadCommitted to skip messages of aborted or open
+	// transactions
+	IsolationLevel sarama.IsolationLevel
+
+	DeadLetterTopic string
+	ResponseTopic   string
+
+	// ResponseTopicMap routes responses to a topic per input topic,
+	// topics which are not in the map use ResponseTopic
+	ResponseTopicMap map[string]string
+
+	// ProducerAcks is how many replicas must have a published record
+	// before it counts as sent, ProducerRetries how often a failed send
+	// is retried and ProducerIdempotent stops retries writing duplicates
+	ProducerAcks       sarama.RequiredAcks
+	ProducerRetries    int
+	ProducerIdempotent bool
+
+	// CopyHeaders are the record headers copied from a message to the
+	// responses published for it
+	CopyHeaders []string
+
+	// ForwardResponseHeaders are the function response headers added
+	// to the records published to the response topic
+	ForwardResponseHeaders []string
+
+	// DeadLetterIncludeBody adds up to MaxDLQBodyBytes of the failed
+	// function's response to dead-lettered messages
+	DeadLetterIncludeBody bool
+	MaxDLQBodyBytes       int
+
+	// StatusTopic receives a record for each invocation, published in
+	// batches of up to StatusBatchSize or every StatusFlushInterval
+	StatusTopic         string
+	StatusBatchSize     int
+	StatusFlushInterval time.Duration
+
+	MaxRetries           int
+	RetryInitialInterval time.Duration
+
+	// ThrottleTimeout is how long an invocation which returned 429 is
+	// retried for without counting towards MaxRetries
+	ThrottleTimeout time.Duration
+
+	// BindAddress is the address the metrics and health servers listen
+	// on, every interface when it is empty
+	BindAddress string
+	MetricsPort int
+	HealthPort  int
+	LagInterval time.Duration
+
+	// OtelEndpoint is the OpenTelemetry collector to export spans to
+	// with OTLP over HTTP, tracing is disabled when it is empty
+	OtelEndpoint string
+
+	ForwardKey   bool
+	HeaderPrefix string
+
+	ContentType    string
+	ContentTypeMap map[string]string
+
+	// ContentTypeHeader names a record header whose value is used as the
+	// Content-Type of the message, ahead of ContentTypeMap
+	ContentTypeHeader string
+
+	// CompressRequest gzips the body of invocations
+	CompressRequest bool
+
+	AsyncInvoke bool
+	MaxInflight int
+
+	// MaxInflightPerTopic caps the workers processing each topic so one
+	// topic can't starve the others, 0 is no cap
+	MaxInflightPerTopic int
+
+	// KeyOrdering processes messages with the same key one at a time, in
+	// the order they were consumed
+	KeyOrdering bool
+
+	// UncommittedWarning is how many messages consumed on a partition
+	// after the highest offset marked as processed are logged as a
+	// warning, 0 disables the warning
+	UncommittedWarning int64
+
+	// InvokeHeaders are set on every invocation, after the headers of
+	// the message so they take precedence. Their values are secret and
+	// never logged
+	InvokeHeaders map[string]string
+
+	// InvokeMethod is the HTTP method functions are invoked with, a
+	// GET has no body
+	InvokeMethod string
+
+	// InvokePathTemplate is the path on the gateway functions are
+	// invoked on, with {name} and {namespace} placeholders
+	InvokePathTemplate string
+
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// BatchSize is the most messages of a topic sent to functions in
+	// one invocation, formatted as BatchFormat, batching is disabled
+	// when it is 0
+	BatchSize    int
+	BatchTimeout time.Duration
+	BatchFormat  string
+
+	// SuccessStatusCodes are the function statuses after which a
+	// message is marked as processed, others are failures
+	SuccessStatusCodes statusCodes
+
+	// SchemaRegistryURL is the Confluent Schema Registry used to decode
+	// Avro keys and values to JSON, they are forwarded as they are when
+	// it is empty
+	SchemaRegistryURL string
+	AvroDecodeKey     bool
+	AvroDecodeValue   bool
+
+	// DedupTTL is how long the key of a message is remembered to skip
+	// duplicates, deduplication is disabled when it is 0
+	DedupTTL    time.Duration
+	DedupSize   int
+	DedupHeader string
+
+	// GatewayTLS is used to verify the gateway for both invocations and
+	// lookups, the system roots are used when it is nil
+	GatewayTLS *tls.Config
+
+	// NoProxyGateway connects to the gateway directly, ignoring the
+	// HTTP_PROXY and HTTPS_PROXY env-vars which other clients still use
+	NoProxyGateway bool
+
+	Filter messageFilter
+
+	// DelayHeader is a record header with the time a message should not
+	// be processed before, which is waited for up to MaxDelay
+	DelayHeader string
+	MaxDelay    time.Duration
+
+	// RouteHeader is a record header naming the functions a message is
+	// sent to, of those bound to its topic, when it is set
+	RouteHeader string
+
+	// BodyTemplate transforms the value of each message into the body
+	// functions are invoked with, values are passed as they are when it
+	// is nil
+	BodyTemplate *template.Template
+
+	// Envelope sends functions the whole message and its metadata as a
+	// JSON envelope instead of the value
+	Envelope bool
+
+	// MaxMessageBytes is the largest message value functions are invoked
+	// with and MaxResponseBytes the largest response read from them
+	MaxMessageBytes  int
+	MaxResponseBytes int64
+
+	// BreakerFailureThreshold is how many consecutive failures open a
+	// function's circuit breaker, 0 disables the breakers
+	BreakerFailureThreshold int
+	BreakerTimeout          time.Duration
+
+	// RateLimit is the default rate at which each function is invoked,
+	// functions can override it with annotations
+	RateLimit rateLimit
+
+	// StickySampling samples messages by their key for functions with
+	// the sample_rate annotation, rather than at random
+	StickySampling bool
+
+	// LogInvocations writes a line for each invocation to stdout, at any
+	// log_level
+	LogInvocations bool
+
+	// ValidateOnly exits once the configuration has been checked
+	// without connecting to the brokers or gateway
+	ValidateOnly bool
 }
 
 func main() {
 
-	credentials := types.GetCredentials()
+	// Replicas started together must not share a sequence, or their
+	// jittered retries and rebuilds stay in lockstep.
+	rand.Seed(time.Now().UnixNano())
+
 	config := buildConnectorConfig()
+	if config.ValidateOnly {
+		log.Printf("Configuration is valid")
+		return
+	}
+
+	registerMetrics()
+	if len(config.OtelEndpoint) > 0 {
+		startTracing(config.OtelEndpoint)
+	}
+
+	topicMap := NewTopicMap()
+	startMetricsServer(config.BindAddress, config.MetricsPort)
+	startHealthServer(config.BindAddress, config.HealthPort, topicMap)
 
-	controller := types.NewController(credentials, config.ControllerConfig)
+	controller := types.NewController(config.Credentials, config.ControllerConfig)
 
-	controller.BeginMapBuilder()
+	limiters := newRateLimiters(config.RateLimit)
+	sampling := newSamplers(config.StickySampling)
+	timeouts := newFunctionTimeouts()
+	if len(config.StaticTopicMap) > 0 {
+		log.Printf("Using the static topic map, functions will not be looked up from the gateway")
+		topicMap.Sync(&config.StaticTopicMap)
+	} else {
+		beginMapBuilder(config, topicMap, limiters, sampling, timeouts)
+	}
+
+	brokers := config.Brokers
+	waitForBrokers(brokers, config, topicMap)
 
-	brokers := []string{config.Broker + ":9092"}
-	waitForBrokers(brokers, config, controller)
+	// Each invocation is bounded by its function's timeout instead, which
+	// may be longer than upstream_timeout.
+	client := makeClient(config.UpstreamTimeout, config)
+	client.Timeout = 0
 
-	makeConsumer(brokers, config, controller)
+	invoker := gatewayInvoker{client: client, limiters: limiters, timeouts: timeouts, config: config}
+	makeConsumer(brokers, config, controller, invoker, sampling, topicMap)
 }
 
-func waitForBrokers(brokers []string, config connectorConfig, controller *types.Controller) {
+func waitForBrokers(brokers []string, config connectorConfig, topicMap *TopicMap) {
 
 	var client sarama.Client
 	var err error
 
+	sConfig := sarama.NewConfig()
+	sConfig.Version = config.KafkaVersion
+	sConfig.ClientID = config.ClientID
+	applySASL(sConfig, config)
+	applyTLS(sConfig, config)
+
+	start := time.Now()
+	attempt := 0
+
 	for {
-		if len(controller.Topics()) > 0 {
-			client, err = sarama.NewClient(brokers, nil)
-			if client != nil && err == nil {
-				break
-			}
-			if client != nil {
-				client.Close()
-			}
-			fmt.Println("Wait for brokers ("+config.Broker+") to come up.. ", brokers)
+		if len(topicMap.Topics()) == 0 {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		client, err = sarama.NewClient(brokers, sConfig)
+		if client != nil && err == nil {
+			break
+		}
+		if client != nil {
+			client.Close()
+		}
+
+		if config.ConnectTimeout > 0 && time.Since(start) >= config.ConnectTimeout {
+			log.Fatalf("Unable to connect to brokers %v within %s: %s", brokers, config.ConnectTimeout, err)
+		}
+
+		attempt++
+		delay := connectDelay(attempt, config.ConnectMaxInterval)
+		log.Printf("Wait for brokers to come up.. %v (attempt %d, retrying in %s): %s", brokers, attempt, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// connectConsumerSet creates a consumer set with create, retrying with
+// backoff until it succeeds or config.ConnectTimeout has passed. The
+// clock is read with now and sleep waits for the backoff.
+func connectConsumerSet(create func() (*consumerSet, error), config connectorConfig, now func() time.Time, sleep func(time.Duration)) (*consumerSet, error) {
+	start := now()
+	for attempt := 1; ; attempt++ {
+		consumers, err := create()
+		if err == nil {
+			return consumers, nil
+		}
+		if config.ConnectTimeout > 0 && now().Sub(start) >= config.ConnectTimeout {
+			return nil, err
 		}
 
-		time.Sleep(1 * time.Second)
+		delay := connectDelay(attempt, config.ConnectMaxInterval)
+		logEvent(levelError, "Unable to create the Kafka consumer, retrying", logFields{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+		})
+		sleep(delay)
 	}
 }
 
-func makeConsumer(brokers []string, config connectorConfig, controller *types.Controller) {
-	//setup consumer
-	cConfig := cluster.NewConfig()
-	cConfig.Version = saramaKafkaProtocolVersion
-	cConfig.Consumer.Return.Errors = true
-	cConfig.Consumer.Offsets.Initial = sarama.OffsetNewest //OffsetOldest
-	cConfig.Group.Return.Notifications = true
-	cConfig.Group.Session.Timeout = 6 * time.Second
-	cConfig.Group.Heartbeat.Interval = 2 * time.Second
+// connectDelay returns the backoff before the given broker connection
+// attempt, starting at 1, which doubles from one second up to max with
+// jitter of up to half of the backoff.
+func connectDelay(attempt int, max time.Duration) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
 
-	group := "faas-kafka-queue-workers"
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	return backoff/2 + jitter
+}
 
+func makeConsumer(brokers []string, config connectorConfig, controller *types.Controller, invoker messageInvoker, sampling *samplers, topicMap *TopicMap) {
 	topics := config.Topics
-	log.Printf("Binding to topics: %v", config.Topics)
+	whitelist := config.TopicPattern
+	if config.DynamicTopics {
+		topics, whitelist = subscription(config.Topics, config.TopicPattern, topicMap)
+	}
 
-	consumer, err := cluster.NewConsumer(brokers, group, topics, cConfig)
+	consumers, err := newConsumerSet(brokers, config, topics, whitelist)
 	if err != nil {
 		log.Fatalln("Fail to create Kafka consumer: ", err)
 	}
 
-	defer consumer.Close()
+	defer func() { consumers.Close() }()
+	setReady(true)
+
+	// Lag is monitored with a client of its own as a consumer's client
+	// can't be shared, the monitor is restarted with each consumer.
+	stopLagMonitor := func() {}
+	var lagClient sarama.Client
+	if config.LagInterval > 0 {
+		lagClient, err = newClient(brokers, config)
+		if err != nil {
+			log.Fatalln("Fail to create Kafka client: ", err)
+		}
+		defer func() { lagClient.Close() }()
+
+		stopLagMonitor = consumers.startLagMonitors(lagClient, config)
+	}
+
+	if !config.KafkaVersion.IsAtLeast(sarama.V0_11_0_0) {
+		log.Printf("kafka_version %s does not support record headers, set kafka_version to 0.11.0.0 or newer to forward them to functions", config.KafkaVersion)
+	}
+
+	var producer sarama.SyncProducer
+	publishes := len(config.DeadLetterTopic) > 0 || len(config.ResponseTopic) > 0 || len(config.ResponseTopicMap) > 0
+	if publishes || len(config.StatusTopic) > 0 {
+		if publishes && !config.KafkaVersion.IsAtLeast(sarama.V0_11_0_0) {
+			log.Printf("kafka_version %s does not support record headers, messages published to the dead-letter and response topics will only have a key and value, without the function, status, source or failure details", config.KafkaVersion)
+		}
+
+		producer, err = makeProducer(brokers, config)
+		if err != nil {
+			log.Fatalln("Fail to create Kafka producer: ", err)
+		}
+		defer func() { producer.Close() }()
+	}
+
+	var status *statusPublisher
+	if len(config.StatusTopic) > 0 {
+		status = newStatusPublisher(producer, config.StatusTopic, config.StatusBatchSize, config.StatusFlushInterval)
+		defer func() { status.Close() }()
+	}
+
+	proc := newProcessor(config, invoker, topicMap, producer, controller.Invoker.Responses)
+	proc.samplers = sampling
+	proc.status = status
+
+	// Stop consuming on SIGINT/SIGTERM and exit if the in-flight
+	// messages and offset commit don't complete within the timeout.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// A fatal consumer error shuts down the same way then exits non-zero.
+	var fatalErr error
+	stop := make(chan struct{}, 1)
+
+	shutdown := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, shutting down", sig)
+		case <-stop:
+			log.Printf("Shutting down after a fatal consumer error")
+		}
+		setReady(false)
+		close(shutdown)
+
+		<-time.After(config.ShutdownTimeout)
+		log.Fatalf("Shutdown did not complete within %s", config.ShutdownTimeout)
+	}()
 
 	num := 0
 
+	// Messages are processed by up to MaxInflight workers, offsets are
+	// marked in order per partition as the workers complete.
+	inflight := make(chan struct{}, config.MaxInflight)
+	wg := sync.WaitGroup{}
+
+	// With dynamic topics the subscription is checked against the topic
+	// map after each rebuild and the consumer re-joins the group when it
+	// has changed.
+	var resubscribe <-chan time.Time
+	if config.DynamicTopics {
+		ticker := time.NewTicker(config.RebuildInterval)
+		defer ticker.Stop()
+		resubscribe = ticker.C
+	}
+
+	// SIGHUP reloads the broker credentials from their files and
+	// reconnects with them.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// With batching messages are accumulated per topic and each batch is
+	// processed by a worker as one message.
+	var batches *batcher
+	if config.BatchSize > 0 {
+		batches = newBatcher(config.BatchSize, config.BatchTimeout)
+	}
+
+	// With max_inflight_per_topic work on a topic which is at its cap
+	// waits for one of the topic's workers to complete.
+	var slots *topicSlots
+	if config.MaxInflightPerTopic > 0 {
+		slots = newTopicSlots(config.MaxInflightPerTopic)
+	}
+
+	// With delay_header messages which are not due yet are held by the
+	// consumer loop until they are, rather than taking a worker.
+	var delays *delayQueue
+	if len(config.DelayHeader) > 0 {
+		delays = newDelayQueue(config.DelayHeader, config.MaxDelay, config.KeyOrdering, batches != nil)
+	}
+
+	process := func(items []consumed) {
+		defer wg.Done()
+		defer func() { <-inflight }()
+		defer slots.Release(items[0].msg.Topic)
+
+		proc.Process(items)
+	}
+
+	// With key_ordering each key is processed in order by one of a fixed
+	// set of workers, rather than by a worker of its own.
+	var lanes *keyLanes
+	if config.KeyOrdering {
+		lanes = newKeyLanes(config.MaxInflight, batches != nil, process)
+	}
+
+	// run processes work once it holds a worker.
+	run := func(items []consumed) {
+		wg.Add(1)
+		if lanes != nil {
+			lanes.Run(items)
+		} else {
+			go process(items)
+		}
+	}
+
+	// start processes work which has its topic's slot once a worker is
+	// free.
+	start := func(items []consumed) {
+		inflight <- struct{}{}
+		run(items)
+	}
+
+	// dispatch processes a batch once its topic and a worker are free.
+	dispatch := func(items []consumed) {
+		if slots.Admit(items) {
+			start(items)
+		}
+	}
+
+	// accept batches or dispatches a message once it is due. A message
+	// which was never dispatched by shutdown is left unmarked to be
+	// consumed again.
+	accept := func(item consumed) {
+		if batches != nil {
+			if items := batches.Add(item); items != nil {
+				dispatch(items)
+			}
+			return
+		}
+
+		if !slots.Admit([]consumed{item}) {
+			return
+		}
+
+		select {
+		case inflight <- struct{}{}:
+		case <-shutdown:
+			slots.Release(item.msg.Topic)
+			return
+		}
+
+		run([]consumed{item})
+	}
+
+	// drain processes the partial batches and the parked work, then
+	// waits for every worker to complete. Messages held until they are
+	// due are left unmarked to be consumed again.
+	drain := func() {
+		if held := delays.Clear(); held > 0 {
+			logEvent(levelWarn, "Leaving delayed messages to be consumed again", logFields{
+				"delayed": held,
+			})
+		}
+		for _, items := range batches.Flush() {
+			dispatch(items)
+		}
+		for released := slots.C(); released != nil; released = slots.C() {
+			<-released
+			for _, items := range slots.Ready() {
+				start(items)
+			}
+		}
+		wg.Wait()
+	}
+
+	// reconnect finishes the in-flight messages and commits their offsets
+	// so the partitions can be handed over cleanly on the rebalance, then
+	// runs update and re-joins the consumer group with a new consumer.
+	reconnect := func(update func()) {
+		drain()
+		stopLagMonitor()
+		if err := consumers.CommitOffsets(); err != nil {
+			logEvent(levelError, "Unable to commit offsets", logFields{"error": err.Error()})
+		}
+		consumers.Close()
+
+		update()
+
+		// The consumer is recreated with backoff, such as when it closed
+		// as the brokers went away, reporting not ready meanwhile.
+		setReady(false)
+		consumers, err = connectConsumerSet(func() (*consumerSet, error) {
+			return newConsumerSet(brokers, config, topics, whitelist)
+		}, config, time.Now, time.Sleep)
+		if err != nil {
+			log.Fatalln("Fail to create Kafka consumer: ", err)
+		}
+		setReady(true)
+
+		proc.tracker.Clear()
+		proc.tracker = newOffsetTracker(config.UncommittedWarning)
+		if lagClient != nil {
+			stopLagMonitor = consumers.startLagMonitors(lagClient, config)
+		}
+	}
+
 	for {
+		// While paused messages are left unread, the consumer stops
+		// fetching once its buffers are full but stays in the group.
+		messages := consumers.Messages()
+		expired := batches.C()
+		due := delays.C()
+		if isPaused() {
+			messages, expired, due = nil, nil, nil
+		}
+		// Likewise while as much work is parked for busy topics, or held
+		// until it is due, as is allowed.
+		if slots.Full() || delays.Full() {
+			messages = nil
+		}
+
 		select {
-		case msg, ok := <-consumer.Messages():
-			if ok {
-				num = (num + 1) % math.MaxInt32
-				fmt.Printf("[#%d] Received on [%v,%v]: '%s'\n",
-					num,
-					msg.Topic,
-					msg.Partition,
-					string(msg.Value))
+		case <-pauseChanged:
+
+		case <-shutdown:
+			// No more messages are read. Partial batches and parked work
+			// are processed rather than left unmarked so they aren't
+			// consumed again after the restart, until the drain timeout
+			// when whatever is still in-flight is abandoned unmarked.
+			drained := make(chan struct{})
+			go func() {
+				drain()
+				close(drained)
+			}()
+
+			var abandon <-chan time.Time
+			if config.DrainTimeout > 0 {
+				abandon = time.After(config.DrainTimeout)
+			}
+
+			select {
+			case <-drained:
+			case <-abandon:
+				logEvent(levelWarn, "Abandoning in-flight messages after the drain timeout", logFields{
+					"drain_timeout": config.DrainTimeout.String(),
+				})
+			}
+
+			stopLagMonitor()
+			if err := consumers.CommitOffsets(); err != nil {
+				logEvent(levelError, "Unable to commit offsets", logFields{"error": err.Error()})
+			}
+			if fatalErr != nil {
+				log.Fatalf("Stopped after a fatal consumer error: %s", fatalErr)
+			}
+			return
+
+		case <-resubscribe:
+			updatedTopics, updatedWhitelist := subscription(config.Topics, config.TopicPattern, topicMap)
+			if len(updatedTopics) == 0 && updatedWhitelist == nil {
+				continue
+			}
+			if sameSubscription(topics, whitelist, updatedTopics, updatedWhitelist) {
+				continue
+			}
+
+			reconnect(func() {
+				topics, whitelist = updatedTopics, updatedWhitelist
+			})
+
+		case <-hangup:
+			password, tlsConfig, err := reloadSecrets(config)
+			if err != nil {
+				logEvent(levelError, "Unable to reload the broker credentials", logFields{"error": err.Error()})
+				continue
+			}
+
+			clusters := make([]clusterConfig, 0, len(config.Clusters))
+			for _, c := range config.Clusters {
+				if c.SASLPassword, c.TLS, err = reloadSecrets(c.apply(config)); err != nil {
+					break
+				}
+				clusters = append(clusters, c)
+			}
+			if err != nil {
+				logEvent(levelError, "Unable to reload the broker credentials", logFields{"error": err.Error()})
+				continue
+			}
+
+			log.Printf("Reloaded the broker credentials, reconnecting")
+			reconnect(func() {
+				config.SASLPassword = password
+				config.TLS = tlsConfig
+				config.Clusters = clusters
+
+				if producer != nil {
+					status.Close()
+					producer.Close()
+					if producer, err = makeProducer(brokers, config); err != nil {
+						log.Fatalln("Fail to create Kafka producer: ", err)
+					}
+					proc.producer = producer
+
+					if status != nil {
+						status = newStatusPublisher(producer, config.StatusTopic, config.StatusBatchSize, config.StatusFlushInterval)
+						proc.status = status
+					}
+				}
+				if lagClient != nil {
+					lagClient.Close()
+					if lagClient, err = newClient(brokers, config); err != nil {
+						log.Fatalln("Fail to create Kafka client: ", err)
+					}
+				}
+			})
+
+		case item := <-messages:
+			msg := item.msg
+			num = (num + 1) % math.MaxInt32
+			messagesConsumed.WithLabelValues(msg.Topic).Inc()
+
+			fields := logFields{
+				"num":       num,
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"bytes":     len(msg.Value),
+			}
+			if config.PrintMessageBody {
+				fields["value"] = string(msg.Value)
+			}
+			logEvent(levelDebug, "Received message", fields)
+
+			proc.tracker.Add(item)
+			if delays.Hold(item) {
+				continue
+			}
+			accept(item)
+
+		case <-due:
+			for _, item := range delays.Due() {
+				accept(item)
+			}
 
-				controller.Invoke(msg.Topic, &msg.Value)
+		case <-expired:
+			for _, items := range batches.Expired() {
+				dispatch(items)
+			}
 
-				consumer.MarkOffset(msg, "") // mark message as processed
+		case <-slots.C():
+			for _, items := range slots.Ready() {
+				start(items)
 			}
-		case err = <-consumer.Errors():
 
-			fmt.Println("consumer error: ", err)
+		case group := <-consumers.Closed():
+			logEvent(levelError, "Consumer closed unexpectedly, reconnecting", logFields{
+				"group": group,
+			})
+			reconnect(func() {})
+
+		case err = <-consumers.Errors():
+			fields, fatal := describeConsumerError(err)
+			topic, _ := fields["topic"].(string)
+			consumerErrors.WithLabelValues(topic, strconv.FormatBool(fatal)).Inc()
+			logEvent(levelError, "Consumer error", fields)
+
+			if fatal && fatalErr == nil {
+				fatalErr = err
+				stop <- struct{}{}
+			}
 
-		case ntf := <-consumer.Notifications():
+		case ntf := <-consumers.Notifications():
 
-			fmt.Printf("Rebalanced: %+v\n", ntf)
+			rebalances.WithLabelValues(ntf.Type.String()).Inc()
+			logEvent(levelInfo, "Rebalanced", logFields{
+				"group":    ntf.group,
+				"type":     ntf.Type.String(),
+				"claimed":  ntf.Claimed,
+				"released": ntf.Released,
+				"current":  ntf.Current,
+			})
 
 		}
 	}
 }
 
-func buildConnectorConfig() connectorConfig {
+// newClient creates a Sarama client for the brokers.
+func newClient(brokers []string, config connectorConfig) (sarama.Client, error) {
+	sConfig := sarama.NewConfig()
+	sConfig.Version = config.KafkaVersion
+	sConfig.ClientID = config.ClientID
+	applySASL(sConfig, config)
+	applyTLS(sConfig, config)
 
-	broker := "kafka"
-	if val, exists := os.LookupEnv("broker_host"); exists {
-		broker = val
+	return sarama.NewClient(brokers, sConfig)
+}
+
+// readSecret reads a secret such as a password from a file, ignoring
+// any surrounding whitespace.
+func readSecret(path string) (string, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(string(value)), nil
+}
 
-	topics := []string{}
-	if val, exists := os.LookupEnv("topics"); exists {
-		for _, topic := range strings.Split(val, ",") {
-			if len(topic) > 0 {
-				topics = append(topics, topic)
-			}
+// reloadSecrets reads the SASL password and TLS configuration from their
+// files again, values which are not read from files are kept.
+func reloadSecrets(config connectorConfig) (string, *tls.Config, error) {
+	password := config.SASLPassword
+	if len(config.SASLPasswordFile) > 0 {
+		var err error
+		if password, err = readSecret(config.SASLPasswordFile); err != nil {
+			return "", nil, err
 		}
 	}
-	if len(topics) == 0 {
-		log.Fatal(`Provide a list of topics i.e. topics="payment_published,slack_joined"`)
+
+	tlsConfig := config.TLS
+	if len(config.BrokerCAFile) > 0 || len(config.BrokerCertFile) > 0 || len(config.BrokerKeyFile) > 0 {
+		var err error
+		if tlsConfig, err = makeTLSConfig(config.BrokerCAFile, config.BrokerCertFile, config.BrokerKeyFile); err != nil {
+			return "", nil, err
+		}
 	}
 
-	gatewayURL := "http://gateway:8080"
-	if val, exists := os.LookupEnv("gateway_url"); exists {
-		gatewayURL = val
+	return password, tlsConfig, nil
+}
+
+// applySASL enables SASL authentication on the Sarama config
+// when a SASL user has been configured.
+func applySASL(sConfig *sarama.Config, config connectorConfig) {
+	if len(config.SASLUser) == 0 {
+		return
 	}
 
-	upstreamTimeout := time.Second * 30
-	rebuildInterval := time.Second * 3
+	sConfig.Net.SASL.Enable = true
+	sConfig.Net.SASL.User = config.SASLUser
+	sConfig.Net.SASL.Password = config.SASLPassword
+	sConfig.Net.SASL.Mechanism = sarama.SASLMechanism(config.SASLMechanism)
 
-	if val, exists := os.LookupEnv("upstream_timeout"); exists {
-		parsedVal, err := time.ParseDuration(val)
-		if err == nil {
-			upstreamTimeout = parsedVal
+	switch config.SASLMechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		sConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		sConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: SHA512}
 		}
 	}
+}
 
-	if val, exists := os.LookupEnv("rebuild_interval"); exists {
-		parsedVal, err := time.ParseDuration(val)
-		if err == nil {
-			rebuildInterval = parsedVal
+// applyTLS enables TLS on the Sarama config when a TLS configuration
+// has been loaded for the broker.
+func applyTLS(sConfig *sarama.Config, config connectorConfig) {
+	if config.TLS == nil {
+		return
+	}
+
+	sConfig.Net.TLS.Enable = true
+	sConfig.Net.TLS.Config = config.TLS
+}
+
+// withDefaultPort appends the default Kafka port to a broker
+// address when it does not specify one.
+func withDefaultPort(broker string) string {
+	if _, _, err := net.SplitHostPort(broker); err == nil {
+		return broker
+	}
+	return net.JoinHostPort(broker, "9092")
+}
+
+// responseTopic returns the topic to publish responses to for messages
+// consumed from topic, or an empty string if they are not published.
+func (c connectorConfig) responseTopic(topic string) string {
+	if val, ok := c.ResponseTopicMap[topic]; ok {
+		return val
+	}
+	return c.ResponseTopic
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
+	return false
+}
 
-	printResponse := false
-	if val, exists := os.LookupEnv("print_response"); exists {
-		printResponse = (val == "1" || val == "true")
+// getCredentials returns the basic auth credentials for the gateway from
+// the basic_auth_user and basic_auth_password env-vars or, when basic_auth
+// is enabled, from the secrets mounted at secret_mount_path. It returns
+// nil when the gateway does not use authentication.
+func getCredentials() (*auth.BasicAuthCredentials, error) {
+	if val, exists := os.LookupEnv("basic_auth_user"); exists && len(val) > 0 {
+		return &auth.BasicAuthCredentials{
+			User:     val,
+			Password: os.Getenv("basic_auth_password"),
+		}, nil
 	}
 
-	printResponseBody := false
-	if val, exists := os.LookupEnv("print_response_body"); exists {
-		printResponseBody = (val == "1" || val == "true")
+	if val, exists := os.LookupEnv("basic_auth"); !exists || !(val == "1" || val == "true") {
+		return nil, nil
 	}
 
-	return connectorConfig{
-		ControllerConfig: &types.ControllerConfig{
-			UpstreamTimeout:   upstreamTimeout,
-			GatewayURL:        gatewayURL,
-			PrintResponse:     printResponse,
-			PrintResponseBody: printResponseBody,
-			RebuildInterval:   rebuildInterval,
-		},
-		Topics: topics,
-		Broker: broker,
+	reader := auth.ReadBasicAuthFromDisk{
+		SecretMountPath: "/var/secrets/",
+	}
+	if val, exists := os.LookupEnv("secret_mount_path"); exists && len(val) > 0 {
+		reader.SecretMountPath = val
+	}
+
+	return reader.Read()
+}
+
+// parseMap parses a comma-separated list of key:value pairs such as
+// "orders:application/json,payments:text/plain". Entries without a
+// value are ignored.
+func parseMap(val string) map[string]string {
+	values := map[string]string{}
+	for _, entry := range strings.Split(val, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if len(key) > 0 && len(value) > 0 {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// parseTopicMap parses a comma-separated list of topic:function pairs
+// such as "orders:process-order,payments:charge". A topic may be listed
+// more than once to bind several functions to it, and may be a "regex:"
+// expression as the last colon separates the function.
+func parseTopicMap(val string) map[string][]string {
+	topicMap := map[string][]string{}
+	for _, entry := range strings.Split(val, ",") {
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			continue
+		}
+
+		topic := strings.TrimSpace(entry[:i])
+		function := strings.TrimSpace(entry[i+1:])
+		if len(topic) > 0 && len(function) > 0 && !contains(topicMap[topic], function) {
+			topicMap[topic] = append(topicMap[topic], function)
+		}
+	}
+	return topicMap
+}
+
+func buildConnectorConfig() connectorConfig {
+
+	// Every invalid setting is collected so they are reported together.
+	problems := []string{}
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Logging is configured first so the warnings below use it.
+	logFormat := "text"
+	if val, exists := os.LookupEnv("log_format"); exists && len(val) > 0 {
+		logFormat = strings.ToLower(val)
+	}
+	switch logFormat {
+	case "text", "json":
+	default:
+		invalid("Unsupported log_format %q, must be one of: text, json", logFormat)
+		logFormat = "text"
+	}
+
+	level := levelInfo
+	if val, exists := os.LookupEnv("log_level"); exists && len(val) > 0 {
+		parsedVal, ok := parseLogLevel(strings.ToLower(val))
+		if !ok {
+			invalid("Unsupported log_level %q, must be one of: debug, info, warn, error", val)
+		} else {
+			level = parsedVal
+		}
+	}
+
+	configureLogging(logFormat, level)
+
+	logInvocations := false
+	if val, exists := os.LookupEnv("log_invocations"); exists {
+		logInvocations = (val == "1" || val == "true")
+	}
+
+	brokers := []string{}
+	if val, exists := os.LookupEnv("broker_host"); exists {
+		for _, broker := range strings.Split(val, ",") {
+			broker = strings.TrimSpace(broker)
+			if len(broker) > 0 {
+				brokers = append(brokers, withDefaultPort(broker))
+			}
+		}
+	}
+	if len(brokers) == 0 {
+		brokers = append(brokers, withDefaultPort("kafka"))
+	}
+
+	group := "faas-kafka-queue-workers"
+	if val, exists := os.LookupEnv("consumer_group"); exists && len(val) > 0 {
+		group = val
+	}
+
+	consumerInstances := 1
+	if val, exists := os.LookupEnv("consumer_instances"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			consumerInstances = parsedVal
+		} else {
+			invalid("consumer_instances %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	// Replicas are told apart by their host name, the pod's name on
+	// Kubernetes.
+	clientID := "kafka-connector"
+	if hostname, err := os.Hostname(); err == nil && clientIDPattern.MatchString(hostname) {
+		clientID += "-" + hostname
+	}
+	if val, exists := os.LookupEnv("client_id"); exists && len(val) > 0 {
+		if clientIDPattern.MatchString(val) {
+			clientID = val
+		} else {
+			invalid("client_id %q is not valid, it must only contain letters, digits, dots, underscores and hyphens", val)
+		}
+	}
+
+	clusters := []clusterConfig{}
+	if val, exists := os.LookupEnv("clusters"); exists {
+		clusters = parseClusters(val, group, invalid)
+	}
+
+	// Topics can be given their own consumer group with topic@group.
+	topics := []string{}
+	topicGroups := map[string]string{}
+	if val, exists := os.LookupEnv("topics"); exists {
+		for _, topic := range strings.Split(val, ",") {
+			if i := strings.LastIndex(topic, "@"); i >= 0 {
+				topicGroup := strings.TrimSpace(topic[i+1:])
+				topic = strings.TrimSpace(topic[:i])
+				if len(topic) > 0 && len(topicGroup) > 0 {
+					if existing, ok := topicGroups[topic]; ok && existing != topicGroup {
+						invalid("Topic %s is in more than one consumer group: %s, %s", topic, existing, topicGroup)
+					}
+					topicGroups[topic] = topicGroup
+				}
+			}
+			if len(topic) > 0 && !contains(topics, topic) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	dynamicTopics := false
+	if val, exists := os.LookupEnv("dynamic_topics"); exists {
+		dynamicTopics = (val == "1" || val == "true")
+	}
+
+	var topicPattern *regexp.Regexp
+	if val, exists := os.LookupEnv("topic_pattern"); exists && len(val) > 0 {
+		parsedVal, err := regexp.Compile("^(?:" + val + ")$")
+		if err == nil {
+			topicPattern = parsedVal
+		} else {
+			invalid("topic_pattern %q is not a valid regular expression: %s", val, err)
+		}
+	}
+
+	topicRefreshInterval := time.Minute * 1
+	if val, exists := os.LookupEnv("topic_refresh_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= time.Second {
+			topicRefreshInterval = parsedVal
+		} else {
+			invalid("topic_refresh_interval %q is not valid, it must be a duration such as 30s of at least 1s", val)
+		}
+	}
+
+	if len(topics) == 0 && !dynamicTopics && topicPattern == nil {
+		invalid(`topics must list at least one topic i.e. topics="payment_published,slack_joined", or set dynamic_topics=true to consume the topics functions are bound to`)
+	}
+
+	namespaces := []string{}
+	if val, exists := os.LookupEnv("namespaces"); exists {
+		for _, namespace := range strings.Split(val, ",") {
+			namespace = strings.TrimSpace(namespace)
+			if len(namespace) > 0 {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+
+	maxLookupFailures := 0
+	if val, exists := os.LookupEnv("max_lookup_failures"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxLookupFailures = parsedVal
+		} else {
+			invalid("max_lookup_failures %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	gatewayURL := "http://gateway:8080"
+	if val, exists := os.LookupEnv("gateway_url"); exists {
+		gatewayURL = val
+	}
+
+	var gatewayTLS *tls.Config
+	gatewayCAFile := os.Getenv("gateway_ca_file")
+	gatewayInsecure := false
+	if val, exists := os.LookupEnv("gateway_insecure_skip_verify"); exists {
+		gatewayInsecure = (val == "1" || val == "true")
+	}
+	if len(gatewayCAFile) > 0 || gatewayInsecure {
+		var err error
+		gatewayTLS, err = makeGatewayTLSConfig(gatewayCAFile, gatewayInsecure)
+		if err != nil {
+			invalid("Unable to configure TLS for the gateway: %s", err)
+		}
+		if gatewayInsecure {
+			log.Printf("gateway_insecure_skip_verify is set, the gateway's certificate will not be verified")
+		}
+	}
+
+	noProxyGateway := false
+	if val, exists := os.LookupEnv("no_proxy_gateway"); exists {
+		noProxyGateway = (val == "1" || val == "true")
+	}
+
+	upstreamTimeout := time.Second * 30
+	rebuildInterval := time.Second * 3
+
+	if val, exists := os.LookupEnv("upstream_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil {
+			upstreamTimeout = parsedVal
+		} else {
+			invalid("upstream_timeout %q is not valid, it must be a duration such as 30s", val)
+		}
+	}
+
+	staticTopicMap := map[string][]string{}
+	if val, exists := os.LookupEnv("topic_map"); exists {
+		staticTopicMap = parseTopicMap(val)
+	}
+
+	lookupTimeout := time.Second * 10
+	if val, exists := os.LookupEnv("lookup_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			lookupTimeout = parsedVal
+		} else {
+			invalid("lookup_timeout %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	shutdownTimeout := time.Second * 30
+	if val, exists := os.LookupEnv("shutdown_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil {
+			shutdownTimeout = parsedVal
+		} else {
+			invalid("shutdown_timeout %q is not valid, it must be a duration such as 30s", val)
+		}
+	}
+
+	drainTimeout := time.Duration(0)
+	if val, exists := os.LookupEnv("drain_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			drainTimeout = parsedVal
+		} else {
+			invalid("drain_timeout %q is not valid, it must be a duration such as 20s which is not negative", val)
+		}
+	}
+	if drainTimeout > 0 && drainTimeout >= shutdownTimeout {
+		invalid("drain_timeout of %s must be less than shutdown_timeout of %s to leave time to commit offsets", drainTimeout, shutdownTimeout)
+	}
+
+	connectTimeout := time.Duration(0)
+	if val, exists := os.LookupEnv("connect_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			connectTimeout = parsedVal
+		} else {
+			invalid("connect_timeout %q is not valid, it must be a duration such as 30s which is not negative", val)
+		}
+	}
+
+	connectMaxInterval := time.Second * 30
+	if val, exists := os.LookupEnv("connect_max_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= time.Second {
+			connectMaxInterval = parsedVal
+		} else {
+			invalid("connect_max_interval %q is not valid, it must be a duration such as 30s of at least 1s", val)
+		}
+	}
+
+	sessionTimeout := time.Second * 6
+	if val, exists := os.LookupEnv("session_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			sessionTimeout = parsedVal
+		} else {
+			invalid("session_timeout %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	heartbeatInterval := time.Millisecond * 1500
+	if val, exists := os.LookupEnv("heartbeat_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			heartbeatInterval = parsedVal
+		} else {
+			invalid("heartbeat_interval %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	rebalanceStrategy := cluster.StrategyRange
+	if val, exists := os.LookupEnv("rebalance_strategy"); exists && len(val) > 0 {
+		switch strings.ToLower(val) {
+		case "range":
+			rebalanceStrategy = cluster.StrategyRange
+		case "roundrobin", "round-robin":
+			rebalanceStrategy = cluster.StrategyRoundRobin
+		case "sticky":
+			invalid("rebalance_strategy sticky is not supported by the consumer group client, must be one of: range, roundrobin")
+		default:
+			invalid("Unsupported rebalance_strategy %q, must be one of: range, roundrobin", val)
+		}
+	}
+	log.Printf("Using the %s rebalance strategy", rebalanceStrategy)
+
+	maxProcessingTime := upstreamTimeout
+	if val, exists := os.LookupEnv("max_processing_time"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			maxProcessingTime = parsedVal
+		} else {
+			invalid("max_processing_time %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	fetchMinBytes := int32(1)
+	if val, exists := os.LookupEnv("fetch_min_bytes"); exists {
+		parsedVal, err := strconv.ParseInt(val, 10, 32)
+		if err == nil && parsedVal > 0 {
+			fetchMinBytes = int32(parsedVal)
+		} else {
+			invalid("fetch_min_bytes %q is not valid, it must be a whole number of bytes greater than 0", val)
+		}
+	}
+
+	fetchDefaultBytes := int32(1024 * 1024)
+	if val, exists := os.LookupEnv("fetch_default_bytes"); exists {
+		parsedVal, err := strconv.ParseInt(val, 10, 32)
+		if err == nil && parsedVal > 0 {
+			fetchDefaultBytes = int32(parsedVal)
+		} else {
+			invalid("fetch_default_bytes %q is not valid, it must be a whole number of bytes greater than 0", val)
+		}
+	}
+
+	fetchMaxBytes := int32(0)
+	if val, exists := os.LookupEnv("fetch_max_bytes"); exists {
+		parsedVal, err := strconv.ParseInt(val, 10, 32)
+		if err == nil && parsedVal >= 0 {
+			fetchMaxBytes = int32(parsedVal)
+		} else {
+			invalid("fetch_max_bytes %q is not valid, it must be a whole number of bytes which is not negative", val)
+		}
+	}
+
+	if fetchMaxBytes > 0 && fetchDefaultBytes > fetchMaxBytes {
+		invalid("fetch_default_bytes %d can't be more than fetch_max_bytes %d", fetchDefaultBytes, fetchMaxBytes)
+	}
+
+	fetchMaxWait := time.Millisecond * 250
+	if val, exists := os.LookupEnv("fetch_max_wait"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= time.Millisecond {
+			fetchMaxWait = parsedVal
+		} else {
+			invalid("fetch_max_wait %q is not valid, it must be a duration such as 250ms of at least 1ms", val)
+		}
+	}
+
+	isolationLevel := sarama.ReadUncommitted
+	if val, exists := os.LookupEnv("isolation_level"); exists {
+		switch val {
+		case "read_uncommitted":
+			isolationLevel = sarama.ReadUncommitted
+		case "read_committed":
+			isolationLevel = sarama.ReadCommitted
+		default:
+			invalid("isolation_level %q is not valid, it must be one of: read_uncommitted, read_committed", val)
+		}
+	}
+
+	// Kafka recommends the heartbeat is no more than a third of the
+	// session timeout so a few can be missed before a rebalance.
+	if heartbeatInterval >= sessionTimeout/3 {
+		log.Printf("heartbeat_interval %s should be less than a third of session_timeout %s", heartbeatInterval, sessionTimeout)
+	}
+
+	if val, exists := os.LookupEnv("rebuild_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil {
+			rebuildInterval = parsedVal
+		} else {
+			invalid("rebuild_interval %q is not valid, it must be a duration such as 30s", val)
+		}
+	}
+
+	skipGatewayCheck := false
+	if val, exists := os.LookupEnv("skip_gateway_check"); exists {
+		skipGatewayCheck = (val == "1" || val == "true")
+	}
+
+	startupLookupTimeout := time.Minute * 2
+	if val, exists := os.LookupEnv("startup_lookup_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			startupLookupTimeout = parsedVal
+		} else {
+			invalid("startup_lookup_timeout %q is not valid, it must be a duration such as 30s which is not negative", val)
+		}
+	}
+
+	rebuildJitter := 0.2
+	if val, exists := os.LookupEnv("rebuild_jitter"); exists {
+		parsedVal, err := strconv.ParseFloat(val, 64)
+		if err == nil && parsedVal >= 0 && parsedVal <= 1 {
+			rebuildJitter = parsedVal
+		} else {
+			invalid("rebuild_jitter %q is not valid, it must be a fraction between 0 and 1", val)
+		}
+	}
+
+	printResponse := false
+	if val, exists := os.LookupEnv("print_response"); exists {
+		printResponse = (val == "1" || val == "true")
+	}
+
+	printResponseBody := false
+	if val, exists := os.LookupEnv("print_response_body"); exists {
+		printResponseBody = (val == "1" || val == "true")
+	}
+
+	processEmpty := false
+	if val, exists := os.LookupEnv("process_empty"); exists {
+		processEmpty = (val == "1" || val == "true")
+	}
+
+	// Message values may hold sensitive data so are only logged when
+	// asked for.
+	printMessageBody := false
+	if val, exists := os.LookupEnv("print_message_body"); exists {
+		printMessageBody = (val == "1" || val == "true")
+	}
+
+	saslUser := ""
+	if val, exists := os.LookupEnv("sasl_user"); exists {
+		saslUser = val
+	}
+
+	saslPassword := ""
+	if val, exists := os.LookupEnv("sasl_password"); exists {
+		saslPassword = val
+	}
+
+	saslPasswordFile := os.Getenv("sasl_password_file")
+	if len(saslPasswordFile) > 0 {
+		password, err := readSecret(saslPasswordFile)
+		if err != nil {
+			invalid("Unable to read sasl_password_file: %s", err)
+		} else {
+			saslPassword = password
+		}
+	}
+
+	saslMechanism := sarama.SASLTypePlaintext
+	if val, exists := os.LookupEnv("sasl_mechanism"); exists && len(val) > 0 {
+		saslMechanism = strings.ToUpper(val)
+	}
+
+	switch saslMechanism {
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+	default:
+		invalid("Unsupported sasl_mechanism %q, must be one of: %s, %s, %s",
+			saslMechanism, sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512)
+	}
+
+	var tlsConfig *tls.Config
+	caFile := os.Getenv("broker_ca_file")
+	certFile := os.Getenv("broker_cert_file")
+	keyFile := os.Getenv("broker_key_file")
+	if len(caFile) > 0 || len(certFile) > 0 || len(keyFile) > 0 {
+		var err error
+		tlsConfig, err = makeTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			invalid("Unable to configure TLS for the broker: %s", err)
+		}
+	}
+
+	kafkaVersion := saramaKafkaProtocolVersion
+	if val, exists := os.LookupEnv("kafka_version"); exists && len(val) > 0 {
+		parsedVal, err := sarama.ParseKafkaVersion(val)
+		if err != nil {
+			invalid("kafka_version %q is not valid: %s", val, err)
+		} else {
+			kafkaVersion = parsedVal
+		}
+	}
+
+	if isolationLevel == sarama.ReadCommitted && !kafkaVersion.IsAtLeast(sarama.V0_11_0_0) {
+		invalid("isolation_level read_committed needs kafka_version 0.11.0.0 or newer, kafka_version is %s", kafkaVersion)
+	}
+
+	initialOffset := sarama.OffsetNewest
+	if val, exists := os.LookupEnv("initial_offset"); exists && len(val) > 0 {
+		switch strings.ToLower(val) {
+		case "newest":
+			initialOffset = sarama.OffsetNewest
+		case "oldest":
+			initialOffset = sarama.OffsetOldest
+		default:
+			invalid("Unsupported initial_offset %q, must be one of: oldest, newest", val)
+		}
+	}
+
+	deadLetterTopic := ""
+	if val, exists := os.LookupEnv("dead_letter_topic"); exists {
+		deadLetterTopic = val
+	}
+
+	deadLetterIncludeBody := false
+	if val, exists := os.LookupEnv("dead_letter_include_body"); exists {
+		deadLetterIncludeBody = (val == "1" || val == "true")
+	}
+
+	maxDLQBodyBytes := 4096
+	if val, exists := os.LookupEnv("max_dlq_body_bytes"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxDLQBodyBytes = parsedVal
+		} else {
+			invalid("max_dlq_body_bytes %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	statusTopic := ""
+	if val, exists := os.LookupEnv("status_topic"); exists {
+		statusTopic = val
+	}
+
+	statusBatchSize := 100
+	if val, exists := os.LookupEnv("status_batch_size"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			statusBatchSize = parsedVal
+		} else {
+			invalid("status_batch_size %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	statusFlushInterval := time.Second
+	if val, exists := os.LookupEnv("status_flush_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			statusFlushInterval = parsedVal
+		} else {
+			invalid("status_flush_interval %q is not valid, it must be a duration such as 1s which is greater than 0", val)
+		}
+	}
+
+	maxRetries := 0
+	if val, exists := os.LookupEnv("max_retries"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxRetries = parsedVal
+		} else {
+			invalid("max_retries %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	retryInitialInterval := time.Second * 1
+	if val, exists := os.LookupEnv("retry_initial_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			retryInitialInterval = parsedVal
+		} else {
+			invalid("retry_initial_interval %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	throttleTimeout := time.Minute * 2
+	if val, exists := os.LookupEnv("throttle_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			throttleTimeout = parsedVal
+		} else {
+			invalid("throttle_timeout %q is not valid, it must be a duration such as 2m which is not negative", val)
+		}
+	}
+
+	bindAddress := ""
+	if val, exists := os.LookupEnv("bind_address"); exists {
+		if net.ParseIP(val) != nil || !strings.ContainsAny(val, ":/ ") {
+			bindAddress = val
+		} else {
+			invalid("bind_address %q is not valid, it must be an IP address or host name without a port", val)
+		}
+	}
+
+	metricsPort := 8081
+	if val, exists := os.LookupEnv("metrics_port"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			metricsPort = parsedVal
+		} else {
+			invalid("metrics_port %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	healthPort := 8082
+	if val, exists := os.LookupEnv("health_port"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			healthPort = parsedVal
+		} else {
+			invalid("health_port %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	lagInterval := time.Second * 30
+	if val, exists := os.LookupEnv("lag_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			lagInterval = parsedVal
+		} else {
+			invalid("lag_interval %q is not valid, it must be a duration such as 30s which is not negative", val)
+		}
+	}
+
+	otelEndpoint := ""
+	if val, exists := os.LookupEnv("otel_endpoint"); exists {
+		otelEndpoint = val
+	}
+
+	forwardKey := true
+	if val, exists := os.LookupEnv("forward_key"); exists {
+		forwardKey = (val == "1" || val == "true")
+	}
+
+	headerPrefix := "X-Kafka-Header-"
+	if val, exists := os.LookupEnv("header_prefix"); exists {
+		headerPrefix = val
+	}
+
+	schemaRegistryURL := os.Getenv("schema_registry_url")
+
+	avroDecodeKey, avroDecodeValue := false, false
+	if val, exists := os.LookupEnv("avro_decode"); exists {
+		for _, part := range strings.Split(val, ",") {
+			switch strings.ToLower(strings.TrimSpace(part)) {
+			case "key":
+				avroDecodeKey = true
+			case "value":
+				avroDecodeValue = true
+			case "":
+			default:
+				invalid("Unsupported avro_decode %q, must be one or both of: key, value", part)
+			}
+		}
+	}
+	if (avroDecodeKey || avroDecodeValue) && len(schemaRegistryURL) == 0 {
+		invalid("avro_decode was given without schema_registry_url")
+	}
+	if len(schemaRegistryURL) > 0 && !avroDecodeKey && !avroDecodeValue {
+		avroDecodeValue = true
+	}
+
+	// Decoded values are JSON unless another content type is set.
+	contentType := "text/plain"
+	if avroDecodeValue {
+		contentType = "application/json"
+	}
+	if val, exists := os.LookupEnv("content_type"); exists && len(val) > 0 {
+		contentType = val
+	}
+
+	contentTypeMap := map[string]string{}
+	if val, exists := os.LookupEnv("content_type_map"); exists {
+		contentTypeMap = parseMap(val)
+	}
+
+	contentTypeHeader := ""
+	if val, exists := os.LookupEnv("content_type_header"); exists {
+		contentTypeHeader = val
+	}
+
+	compressRequest := false
+	if val, exists := os.LookupEnv("compress_request"); exists {
+		compressRequest = (val == "1" || val == "true")
+	}
+
+	asyncInvoke := false
+	if val, exists := os.LookupEnv("async_invoke"); exists {
+		asyncInvoke = (val == "1" || val == "true")
+	}
+
+	invokePathTemplate := "/function/{name}"
+	if asyncInvoke {
+		invokePathTemplate = "/async-function/{name}"
+	}
+	if val, exists := os.LookupEnv("invoke_path_template"); exists && len(val) > 0 {
+		invokePathTemplate = val
+	}
+	if !strings.Contains(invokePathTemplate, "{name}") {
+		invalid("invoke_path_template %q must contain {name}", invokePathTemplate)
+	}
+	if !strings.HasPrefix(invokePathTemplate, "/") {
+		invokePathTemplate = "/" + invokePathTemplate
+	}
+
+	batchSize := 0
+	if val, exists := os.LookupEnv("batch_size"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			batchSize = parsedVal
+		} else {
+			invalid("batch_size %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	batchTimeout := time.Second * 1
+	if val, exists := os.LookupEnv("batch_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			batchTimeout = parsedVal
+		} else {
+			invalid("batch_timeout %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	batchFormat := "json"
+	if val, exists := os.LookupEnv("batch_format"); exists && len(val) > 0 {
+		batchFormat = strings.ToLower(val)
+	}
+	switch batchFormat {
+	case "json", "ndjson":
+	default:
+		invalid("Unsupported batch_format %q, must be one of: json, ndjson", batchFormat)
+	}
+
+	delayHeader := os.Getenv("delay_header")
+
+	maxDelay := time.Minute * 1
+	if val, exists := os.LookupEnv("max_delay"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			maxDelay = parsedVal
+		} else {
+			invalid("max_delay %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	routeHeader := os.Getenv("route_header")
+	if len(routeHeader) > 0 && batchSize > 0 {
+		invalid("route_header can't be used with batch_size as the messages in a batch may be routed to different functions")
+	}
+
+	invokeHeaders := map[string]string{}
+	if val, exists := os.LookupEnv("invoke_headers"); exists {
+		for name, value := range parseMap(val) {
+			if sanitizeHeaderName(name) != name || reservedHeaders[http.CanonicalHeaderKey(name)] {
+				invalid("invoke_headers has an invalid header name %q", name)
+				continue
+			}
+			invokeHeaders[name] = sanitizeHeaderValue(value)
+		}
+	}
+	if len(invokeHeaders) > 0 {
+		names := make([]string, 0, len(invokeHeaders))
+		for name := range invokeHeaders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Printf("Setting the headers %s on every invocation", strings.Join(names, ", "))
+	}
+
+	invokeMethod := http.MethodPost
+	if val, exists := os.LookupEnv("invoke_method"); exists && len(val) > 0 {
+		invokeMethod = strings.ToUpper(val)
+	}
+	switch invokeMethod {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodGet:
+	default:
+		invalid("Unsupported invoke_method %q, must be one of: POST, PUT, PATCH, GET", invokeMethod)
+	}
+
+	maxInflight := 1
+	if val, exists := os.LookupEnv("max_inflight"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			maxInflight = parsedVal
+		} else {
+			invalid("max_inflight %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	uncommittedWarning := int64(0)
+	if val, exists := os.LookupEnv("uncommitted_warning"); exists {
+		parsedVal, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && parsedVal >= 0 {
+			uncommittedWarning = parsedVal
+		} else {
+			invalid("uncommitted_warning %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	maxInflightPerTopic := 0
+	if val, exists := os.LookupEnv("max_inflight_per_topic"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxInflightPerTopic = parsedVal
+		} else {
+			invalid("max_inflight_per_topic %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	keyOrdering := false
+	if val, exists := os.LookupEnv("key_ordering"); exists {
+		keyOrdering = (val == "1" || val == "true")
+	}
+
+	idleConnTimeout := time.Second * 120
+	if val, exists := os.LookupEnv("idle_conn_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			idleConnTimeout = parsedVal
+		} else {
+			invalid("idle_conn_timeout %q is not valid, it must be a duration such as 30s which is not negative", val)
+		}
+	}
+
+	maxIdleConns := 100
+	if val, exists := os.LookupEnv("max_idle_conns"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxIdleConns = parsedVal
+		} else {
+			invalid("max_idle_conns %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	maxIdleConnsPerHost := 100
+	if val, exists := os.LookupEnv("max_idle_conns_per_host"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxIdleConnsPerHost = parsedVal
+		} else {
+			invalid("max_idle_conns_per_host %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	limit := 0.0
+	if val, exists := os.LookupEnv("rate_limit"); exists {
+		parsedVal, err := strconv.ParseFloat(val, 64)
+		if err == nil && parsedVal >= 0 {
+			limit = parsedVal
+		} else {
+			invalid("rate_limit %q is not valid, it must be a number which is not negative", val)
+		}
+	}
+
+	burst := burstFor(limit)
+	if val, exists := os.LookupEnv("rate_burst"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			burst = parsedVal
+		} else {
+			invalid("rate_burst %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	stickySampling := false
+	if val, exists := os.LookupEnv("sticky_sampling"); exists {
+		stickySampling = (val == "1" || val == "true")
+	}
+
+	filter := messageFilter{
+		Header:    os.Getenv("filter_header"),
+		Value:     os.Getenv("filter_value"),
+		PathValue: os.Getenv("filter_jsonpath_value"),
+	}
+	if val, exists := os.LookupEnv("filter_jsonpath"); exists && len(val) > 0 {
+		path, err := parseJSONPath(val)
+		if err != nil {
+			invalid("Invalid filter_jsonpath %q: %s", val, err)
+		}
+		filter.Path = path
+	}
+
+	var bodyTemplate *template.Template
+	if val, exists := os.LookupEnv("body_template"); exists && len(val) > 0 {
+		parsedVal, err := parseBodyTemplate(val)
+		if err == nil {
+			bodyTemplate = parsedVal
+		} else {
+			invalid("body_template is not valid: %s", err)
+		}
+	}
+
+	envelope := false
+	if val, exists := os.LookupEnv("envelope"); exists {
+		envelope = (val == "1" || val == "true")
+	}
+	if envelope && bodyTemplate != nil {
+		invalid("envelope and body_template can't be used together as both replace the body")
+	}
+
+	maxMessageBytes := 0
+	if val, exists := os.LookupEnv("max_message_bytes"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			maxMessageBytes = parsedVal
+		} else {
+			invalid("max_message_bytes %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	maxResponseBytes := int64(10 * 1024 * 1024)
+	if val, exists := os.LookupEnv("max_response_bytes"); exists {
+		parsedVal, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && parsedVal > 0 {
+			maxResponseBytes = parsedVal
+		} else {
+			invalid("max_response_bytes %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	breakerFailureThreshold := 0
+	if val, exists := os.LookupEnv("breaker_failure_threshold"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			breakerFailureThreshold = parsedVal
+		} else {
+			invalid("breaker_failure_threshold %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	breakerTimeout := time.Second * 30
+	if val, exists := os.LookupEnv("breaker_timeout"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			breakerTimeout = parsedVal
+		} else {
+			invalid("breaker_timeout %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	responseTopic := ""
+	if val, exists := os.LookupEnv("response_topic"); exists {
+		responseTopic = val
+	}
+
+	responseTopicMap := map[string]string{}
+	if val, exists := os.LookupEnv("response_topic_map"); exists {
+		responseTopicMap = parseMap(val)
+	}
+	for topic := range responseTopicMap {
+		if !contains(topics, topic) {
+			log.Printf("response_topic_map has an entry for %s which is not in topics", topic)
+		}
+	}
+
+	producerAcks := sarama.WaitForAll
+	if val, exists := os.LookupEnv("producer_acks"); exists {
+		switch val {
+		case "none":
+			producerAcks = sarama.NoResponse
+		case "leader":
+			producerAcks = sarama.WaitForLocal
+		case "all":
+			producerAcks = sarama.WaitForAll
+		default:
+			invalid("producer_acks %q is not valid, it must be one of: none, leader, all", val)
+		}
+	}
+
+	producerRetries := 3
+	if val, exists := os.LookupEnv("producer_retries"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal >= 0 {
+			producerRetries = parsedVal
+		} else {
+			invalid("producer_retries %q is not valid, it must be a whole number which is not negative", val)
+		}
+	}
+
+	producerIdempotent := false
+	if val, exists := os.LookupEnv("producer_idempotent"); exists {
+		producerIdempotent = (val == "1" || val == "true")
+	}
+	if producerIdempotent {
+		if !kafkaVersion.IsAtLeast(sarama.V0_11_0_0) {
+			invalid("producer_idempotent needs kafka_version 0.11.0.0 or newer, kafka_version is %s", kafkaVersion)
+		}
+		if producerAcks != sarama.WaitForAll {
+			invalid("producer_idempotent needs producer_acks to be all")
+		}
+		if producerRetries < 1 {
+			invalid("producer_idempotent needs producer_retries to be at least 1")
+		}
+	}
+
+	copyHeaders := []string{}
+	if val, exists := os.LookupEnv("copy_headers"); exists {
+		for _, header := range strings.Split(val, ",") {
+			header = strings.TrimSpace(header)
+			if len(header) > 0 {
+				copyHeaders = append(copyHeaders, header)
+			}
+		}
+	}
+
+	forwardResponseHeaders := []string{}
+	if val, exists := os.LookupEnv("forward_response_headers"); exists {
+		for _, header := range strings.Split(val, ",") {
+			header = strings.TrimSpace(header)
+			if len(header) == 0 {
+				continue
+			}
+			if reservedHeaders[http.CanonicalHeaderKey(header)] {
+				invalid("forward_response_headers can't include the hop-by-hop header %s", header)
+				continue
+			}
+			forwardResponseHeaders = append(forwardResponseHeaders, header)
+		}
+	}
+
+	successStatusCodes := defaultSuccessCodes
+	if val, exists := os.LookupEnv("success_status_codes"); exists && len(val) > 0 {
+		parsedVal, err := parseStatusCodes(val)
+		if err == nil {
+			successStatusCodes = parsedVal
+		} else {
+			invalid("success_status_codes %q is not valid, it must be statuses or ranges such as 200-299,304: %s", val, err)
+		}
+	}
+
+	dedupTTL := time.Duration(0)
+	if val, exists := os.LookupEnv("dedup_ttl"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal >= 0 {
+			dedupTTL = parsedVal
+		} else {
+			invalid("dedup_ttl %q is not valid, it must be a duration such as 30s which is not negative", val)
+		}
+	}
+
+	dedupSize := 10000
+	if val, exists := os.LookupEnv("dedup_size"); exists {
+		parsedVal, err := strconv.Atoi(val)
+		if err == nil && parsedVal > 0 {
+			dedupSize = parsedVal
+		} else {
+			invalid("dedup_size %q is not valid, it must be a whole number greater than 0", val)
+		}
+	}
+
+	dedupHeader := ""
+	if val, exists := os.LookupEnv("dedup_header"); exists {
+		dedupHeader = val
+	}
+
+	commitInterval := time.Second * 1
+	if val, exists := os.LookupEnv("commit_interval"); exists {
+		parsedVal, err := time.ParseDuration(val)
+		if err == nil && parsedVal > 0 {
+			commitInterval = parsedVal
+		} else {
+			invalid("commit_interval %q is not valid, it must be a duration such as 30s greater than 0", val)
+		}
+	}
+
+	manualCommit := false
+	if val, exists := os.LookupEnv("manual_commit"); exists {
+		manualCommit = (val == "1" || val == "true")
+	}
+
+	atLeastOnce := true
+	if val, exists := os.LookupEnv("at_least_once"); exists {
+		atLeastOnce = (val == "1" || val == "true")
+	}
+
+	credentials, err := getCredentials()
+	if err != nil {
+		invalid("Unable to read gateway credentials: %s", err)
+	} else if credentials != nil && len(credentials.Password) == 0 {
+		invalid("basic_auth_user was given without basic_auth_password")
+	}
+
+	if len(saslUser) > 0 && len(saslPassword) == 0 {
+		invalid("sasl_user was given without sasl_password or sasl_password_file")
+	}
+	if len(saslPassword) > 0 && len(saslUser) == 0 {
+		invalid("sasl_password was given without sasl_user")
+	}
+	if deadLetterIncludeBody && len(deadLetterTopic) == 0 {
+		invalid("dead_letter_include_body was given without dead_letter_topic")
+	}
+	if len(filter.Value) > 0 && len(filter.Header) == 0 {
+		invalid("filter_value was given without filter_header")
+	}
+	if len(filter.PathValue) > 0 && len(filter.Path) == 0 {
+		invalid("filter_jsonpath_value was given without filter_jsonpath")
+	}
+
+	if len(problems) > 0 {
+		log.Fatalf("Invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	validateOnly := false
+	if val, exists := os.LookupEnv("validate_only"); exists {
+		validateOnly = (val == "1" || val == "true")
+	}
+	for _, arg := range os.Args[1:] {
+		if arg == "--validate" || arg == "-validate" {
+			validateOnly = true
+		}
+	}
+
+	return connectorConfig{
+		Credentials: credentials,
+		ControllerConfig: &types.ControllerConfig{
+			UpstreamTimeout:   upstreamTimeout,
+			GatewayURL:        gatewayURL,
+			PrintResponse:     printResponse,
+			PrintResponseBody: printResponseBody,
+			RebuildInterval:   rebuildInterval,
+		},
+		Topics:     topics,
+		Namespaces: namespaces,
+
+		PrintMessageBody: printMessageBody,
+		ProcessEmpty:     processEmpty,
+
+		Clusters: clusters,
+
+		TopicGroups: topicGroups,
+
+		TopicPattern:         topicPattern,
+		TopicRefreshInterval: topicRefreshInterval,
+
+		DynamicTopics: dynamicTopics,
+
+		StaticTopicMap: staticTopicMap,
+
+		LookupTimeout: lookupTimeout,
+		RebuildJitter: rebuildJitter,
+
+		SkipGatewayCheck:     skipGatewayCheck,
+		StartupLookupTimeout: startupLookupTimeout,
+
+		MaxLookupFailures: maxLookupFailures,
+		Brokers:           brokers,
+		Group:             group,
+		ConsumerInstances: consumerInstances,
+		ClientID:          clientID,
+		SASLUser:          saslUser,
+		SASLPassword:      saslPassword,
+		SASLMechanism:     saslMechanism,
+		TLS:               tlsConfig,
+		KafkaVersion:      kafkaVersion,
+		InitialOffset:     initialOffset,
+		AtLeastOnce:       atLeastOnce,
+		ShutdownTimeout:   shutdownTimeout,
+		DrainTimeout:      drainTimeout,
+
+		CommitInterval: commitInterval,
+		ManualCommit:   manualCommit,
+
+		ConnectTimeout:     connectTimeout,
+		ConnectMaxInterval: connectMaxInterval,
+
+		SASLPasswordFile: saslPasswordFile,
+		BrokerCAFile:     caFile,
+		BrokerCertFile:   certFile,
+		BrokerKeyFile:    keyFile,
+
+		SessionTimeout:    sessionTimeout,
+		HeartbeatInterval: heartbeatInterval,
+		RebalanceStrategy: rebalanceStrategy,
+
+		MaxProcessingTime: maxProcessingTime,
+
+		FetchMinBytes:     fetchMinBytes,
+		FetchDefaultBytes: fetchDefaultBytes,
+		FetchMaxBytes:     fetchMaxBytes,
+		FetchMaxWait:      fetchMaxWait,
+
+		IsolationLevel: isolationLevel,
+
+		DeadLetterTopic: deadLetterTopic,
+		ResponseTopic:   responseTopic,
+
+		ResponseTopicMap: responseTopicMap,
+
+		ProducerAcks:       producerAcks,
+		ProducerRetries:    producerRetries,
+		ProducerIdempotent: producerIdempotent,
+
+		CopyHeaders:            copyHeaders,
+		ForwardResponseHeaders: forwardResponseHeaders,
+
+		DeadLetterIncludeBody: deadLetterIncludeBody,
+		MaxDLQBodyBytes:       maxDLQBodyBytes,
+
+		StatusTopic:         statusTopic,
+		StatusBatchSize:     statusBatchSize,
+		StatusFlushInterval: statusFlushInterval,
+
+		MaxRetries:           maxRetries,
+		RetryInitialInterval: retryInitialInterval,
+		ThrottleTimeout:      throttleTimeout,
+
+		BindAddress: bindAddress,
+		MetricsPort: metricsPort,
+		HealthPort:  healthPort,
+		LagInterval: lagInterval,
+
+		OtelEndpoint: otelEndpoint,
+
+		ForwardKey:   forwardKey,
+		HeaderPrefix: headerPrefix,
+
+		ContentType:       contentType,
+		ContentTypeMap:    contentTypeMap,
+		ContentTypeHeader: contentTypeHeader,
+		CompressRequest:   compressRequest,
+
+		AsyncInvoke:         asyncInvoke,
+		MaxInflight:         maxInflight,
+		MaxInflightPerTopic: maxInflightPerTopic,
+		KeyOrdering:         keyOrdering,
+		UncommittedWarning:  uncommittedWarning,
+
+		InvokeHeaders:      invokeHeaders,
+		InvokeMethod:       invokeMethod,
+		InvokePathTemplate: invokePathTemplate,
+
+		IdleConnTimeout:     idleConnTimeout,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+
+		BatchSize:    batchSize,
+		BatchTimeout: batchTimeout,
+		BatchFormat:  batchFormat,
+
+		SuccessStatusCodes: successStatusCodes,
+
+		SchemaRegistryURL: schemaRegistryURL,
+		AvroDecodeKey:     avroDecodeKey,
+		AvroDecodeValue:   avroDecodeValue,
+
+		DedupTTL:    dedupTTL,
+		DedupSize:   dedupSize,
+		DedupHeader: dedupHeader,
+
+		GatewayTLS:     gatewayTLS,
+		NoProxyGateway: noProxyGateway,
+
+		Filter:       filter,
+		BodyTemplate: bodyTemplate,
+		Envelope:     envelope,
+		RouteHeader:  routeHeader,
+		DelayHeader:  delayHeader,
+		MaxDelay:     maxDelay,
+
+		MaxMessageBytes:  maxMessageBytes,
+		MaxResponseBytes: maxResponseBytes,
+
+		BreakerFailureThreshold: breakerFailureThreshold,
+		BreakerTimeout:          breakerTimeout,
+
+		RateLimit: rateLimit{Limit: limit, Burst: burst},
+
+		StickySampling: stickySampling,
+
+		LogInvocations: logInvocations,
+
+		ValidateOnly: validateOnly,
 	}
 }
@@ -0,0 +1,127 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_messages_consumed_total",
+		Help: "Messages consumed from Kafka per topic",
+	}, []string{"topic"})
+
+	invocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_invocations_total",
+		Help: "Function invocations per function",
+	}, []string{"function"})
+
+	invocationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_invocation_failures_total",
+		Help: "Function invocations which failed or returned a non-2xx status per function",
+	}, []string{"function"})
+
+	invocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_connector_invocation_duration_seconds",
+		Help:    "Latency of function invocations including retries",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"function"})
+
+	rebalances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_rebalances_total",
+		Help: "Consumer group rebalance notifications per type",
+	}, []string{"type"})
+
+	consumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_connector_consumer_lag",
+		Help: "Messages behind the high-water mark per topic and partition owned by the connector",
+	}, []string{"topic", "partition"})
+
+	uncommittedMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_connector_uncommitted_messages",
+		Help: "Messages consumed after the highest offset marked as processed per topic and partition, which would be consumed again after a restart",
+	}, []string{"topic", "partition"})
+
+	breakerStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_connector_circuit_breaker_state",
+		Help: "State of the circuit breaker per function, 0 is closed, 1 half-open and 2 open",
+	}, []string{"function"})
+
+	emptyMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_empty_messages_skipped_total",
+		Help: "Messages skipped as their value was empty per topic",
+	}, []string{"topic"})
+
+	messagesDeduplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_messages_deduplicated_total",
+		Help: "Messages skipped as duplicates per topic",
+	}, []string{"topic"})
+
+	matchedFunctions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_connector_matched_functions",
+		Help: "Functions bound to the topic of the last message consumed per topic",
+	}, []string{"topic"})
+
+	unboundMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_unbound_messages_total",
+		Help: "Messages consumed from a topic without any functions bound per topic",
+	}, []string{"topic"})
+
+	throttledInvocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_throttled_invocations_total",
+		Help: "Function invocations which returned 429 as the function was at capacity per function",
+	}, []string{"function"})
+
+	consumerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_connector_consumer_errors_total",
+		Help: "Errors from the Kafka consumers per topic, which is empty when not known, and whether they were fatal",
+	}, []string{"topic", "fatal"})
+)
+
+// registerMetrics registers the connector's collectors with the
+// default Prometheus registry.
+func registerMetrics() {
+	prometheus.MustRegister(
+		messagesConsumed,
+		invocations,
+		invocationFailures,
+		invocationDuration,
+		rebalances,
+		consumerLag,
+		uncommittedMessages,
+		breakerStates,
+		emptyMessages,
+		messagesDeduplicated,
+		matchedFunctions,
+		unboundMessages,
+		throttledInvocations,
+		consumerErrors,
+	)
+}
+
+// startMetricsServer serves /metrics on the given address and port in
+// the background, on every interface when address is empty.
+func startMetricsServer(address string, port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	s := &http.Server{
+		Addr:    net.JoinHostPort(address, strconv.Itoa(port)),
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Serving metrics on %s", s.Addr)
+		if err := s.ListenAndServe(); err != nil {
+			log.Fatalf("Unable to serve metrics: %s", err)
+		}
+	}()
+}
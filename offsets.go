@@ -0,0 +1,135 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// offsetTracker orders the completion of messages which are processed
+// concurrently so that an offset is only marked once every earlier
+// message on the same partition has completed. Partitions are tracked
+// per consumer as consumers of different clusters can share topic names.
+//
+// The gap between the highest offset consumed and the highest marked on
+// each partition is reported as the messages which would be consumed
+// again after a restart, with a warning once it exceeds the threshold.
+type offsetTracker struct {
+	lock       sync.Mutex
+	partitions map[trackedPartition][]*trackedOffset
+
+	threshold int64
+	consumed  map[trackedPartition]int64
+	marked    map[trackedPartition]int64
+	warned    map[trackedPartition]bool
+}
+
+type trackedPartition struct {
+	consumer  offsetMarker
+	topic     string
+	partition int32
+}
+
+type trackedOffset struct {
+	offset int64
+	done   bool
+	mark   bool
+}
+
+// newOffsetTracker creates a tracker which warns when more than
+// threshold messages on a partition are unmarked, 0 disables the warning.
+func newOffsetTracker(threshold int64) *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[trackedPartition][]*trackedOffset),
+		threshold:  threshold,
+		consumed:   make(map[trackedPartition]int64),
+		marked:     make(map[trackedPartition]int64),
+		warned:     make(map[trackedPartition]bool),
+	}
+}
+
+// Add records that a message has been dispatched for processing.
+func (t *offsetTracker) Add(item consumed) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := trackedPartition{item.consumer, item.msg.Topic, item.msg.Partition}
+	t.partitions[key] = append(t.partitions[key], &trackedOffset{offset: item.msg.Offset})
+
+	if _, ok := t.marked[key]; !ok {
+		t.marked[key] = item.msg.Offset - 1
+	}
+	t.consumed[key] = item.msg.Offset
+	t.report(key)
+}
+
+// Done records that a message has completed and whether its offset may
+// be marked. It returns the highest offset on the message's partition
+// which can now be marked as processed, or false if there is none.
+func (t *offsetTracker) Done(item consumed, mark bool) (int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := trackedPartition{item.consumer, item.msg.Topic, item.msg.Partition}
+	pending := t.partitions[key]
+	for _, tracked := range pending {
+		if tracked.offset == item.msg.Offset {
+			tracked.done = true
+			tracked.mark = mark
+			break
+		}
+	}
+
+	var offset int64
+	found := false
+	for len(pending) > 0 && pending[0].done {
+		if pending[0].mark {
+			offset = pending[0].offset
+			found = true
+		}
+		pending = pending[1:]
+	}
+	t.partitions[key] = pending
+
+	if found {
+		t.marked[key] = offset
+		t.report(key)
+	}
+
+	return offset, found
+}
+
+// Clear removes the gaps reported for the tracked partitions, such as
+// before they are handed to a new consumer.
+func (t *offsetTracker) Clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.consumed {
+		uncommittedMessages.DeleteLabelValues(key.topic, strconv.Itoa(int(key.partition)))
+	}
+}
+
+// report updates the gap of the partition and warns when it first
+// exceeds the threshold, it is called with the lock held.
+func (t *offsetTracker) report(key trackedPartition) {
+	gap := t.consumed[key] - t.marked[key]
+	uncommittedMessages.WithLabelValues(key.topic, strconv.Itoa(int(key.partition))).Set(float64(gap))
+
+	if t.threshold <= 0 {
+		return
+	}
+	if gap > t.threshold && !t.warned[key] {
+		logEvent(levelWarn, "Offsets marked as processed are falling behind consumption", logFields{
+			"topic":     key.topic,
+			"partition": key.partition,
+			"unmarked":  gap,
+			"threshold": t.threshold,
+		})
+		t.warned[key] = true
+	} else if gap <= t.threshold {
+		t.warned[key] = false
+	}
+}
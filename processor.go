@@ -0,0 +1,504 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/openfaas-incubator/connector-sdk/types"
+)
+
+// messageInvoker invokes a function with a message, when msg is a batch,
+// batch is the number of messages it holds, otherwise it is 0.
+type messageInvoker interface {
+	Invoke(function string, msg *sarama.ConsumerMessage, batch int) types.InvokerResponse
+}
+
+// functionMatcher returns the functions bound to a topic, it is
+// implemented by TopicMap.
+type functionMatcher interface {
+	Match(topicName string) []string
+}
+
+// offsetMarker marks and commits the offsets of the messages received by
+// a consumer, it is implemented by the consumers of sarama-cluster.
+type offsetMarker interface {
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
+	CommitOffsets() error
+}
+
+// gatewayInvoker invokes functions through the gateway with client.
+type gatewayInvoker struct {
+	client   *http.Client
+	limiters *rateLimiters
+	timeouts *functionTimeouts
+	config   connectorConfig
+}
+
+// Invoke calls function through the gateway, retrying as configured and
+// with the function's own timeout when it has one.
+func (g gatewayInvoker) Invoke(function string, msg *sarama.ConsumerMessage, batch int) types.InvokerResponse {
+	config := g.config
+	config.UpstreamTimeout = g.timeouts.For(function, config.UpstreamTimeout)
+
+	return invokeFunction(g.client, g.limiters, config, function, msg, batch)
+}
+
+// processor invokes the functions bound to the topics of consumed
+// messages and marks their offsets once they have been processed. The
+// invoker, topic map and producer are interfaces so processing can be
+// exercised without a gateway or brokers.
+type processor struct {
+	config    connectorConfig
+	invoker   messageInvoker
+	functions functionMatcher
+
+	// producer publishes responses and dead-lettered messages, it is nil
+	// when neither are configured
+	producer sarama.SyncProducer
+
+	// responses receives the response of each invocation
+	responses chan<- types.InvokerResponse
+
+	tracker  *offsetTracker
+	breakers *breakers
+	dedup    *dedupCache
+	decoder  *avroDecoder
+
+	// samplers skips the messages which are not sampled for functions
+	// with a sample rate, every message is sent to functions when nil
+	samplers *samplers
+
+	// status publishes a record of each invocation when status_topic is
+	// set, it is nil otherwise
+	status *statusPublisher
+
+	// Messages on topics without functions are a sign of a missing or
+	// renamed annotation, the warning is logged once a minute per topic.
+	unbound *logThrottle
+}
+
+func newProcessor(config connectorConfig, invoker messageInvoker, functions functionMatcher, producer sarama.SyncProducer, responses chan<- types.InvokerResponse) *processor {
+	p := &processor{
+		config:    config,
+		invoker:   invoker,
+		functions: functions,
+		producer:  producer,
+		responses: responses,
+		tracker:   newOffsetTracker(config.UncommittedWarning),
+		breakers:  newBreakers(config.BreakerFailureThreshold, config.BreakerTimeout),
+		unbound:   newLogThrottle(time.Minute),
+	}
+
+	if config.DedupTTL > 0 {
+		p.dedup = newDedupCache(config.DedupTTL, config.DedupSize, config.DedupHeader)
+	}
+	if len(config.SchemaRegistryURL) > 0 {
+		p.decoder = newAvroDecoder(config.SchemaRegistryURL, config.AvroDecodeKey, config.AvroDecodeValue)
+	}
+
+	return p
+}
+
+// Process processes items as one batch when batching is enabled,
+// otherwise items holds a single message. The offsets of items are
+// marked unless processing failed with at_least_once set, and committed
+// when commits are manual.
+func (p *processor) Process(items []consumed) {
+	msgs := make([]*sarama.ConsumerMessage, 0, len(items))
+	for _, item := range items {
+		msgs = append(msgs, item.msg)
+	}
+
+	var err error
+	if p.config.BatchSize > 0 {
+		err = p.processBatch(msgs)
+	} else {
+		err = p.processMessage(msgs[0])
+	}
+
+	mark := true
+	if err != nil && p.config.AtLeastOnce {
+		fields := logFields{
+			"topic":     msgs[0].Topic,
+			"partition": msgs[0].Partition,
+			"offset":    msgs[0].Offset,
+			"error":     err.Error(),
+		}
+		if p.config.BatchSize > 0 {
+			fields["batch_size"] = len(msgs)
+		}
+		logEvent(levelWarn, "Not marking offset as processed", fields)
+		mark = false
+	}
+
+	// A batch's offsets are marked together as it succeeds or fails
+	// as a whole.
+	marked := map[offsetMarker]bool{}
+	for _, item := range items {
+		msg := item.msg
+		if offset, ok := p.tracker.Done(item, mark); ok {
+			item.consumer.MarkPartitionOffset(msg.Topic, msg.Partition, offset, "") // mark message as processed
+			marked[item.consumer] = true
+		}
+	}
+
+	// With manual commits the offsets are committed before the worker
+	// takes the next message or batch.
+	if p.config.ManualCommit {
+		for consumer := range marked {
+			if err := consumer.CommitOffsets(); err != nil {
+				logEvent(levelError, "Unable to commit offsets", logFields{"error": err.Error()})
+			}
+		}
+	}
+}
+
+func (p *processor) processMessage(msg *sarama.ConsumerMessage) error {
+	admitted, key, err := p.admit(msg)
+	if admitted == nil || err != nil {
+		return err
+	}
+	if err := p.deliver(admitted, nil, []*sarama.ConsumerMessage{msg}); err != nil {
+		return err
+	}
+
+	p.dedup.Remember(key)
+	return nil
+}
+
+// processBatch invokes the functions bound to the topic of msgs once with
+// every message which is not skipped.
+func (p *processor) processBatch(msgs []*sarama.ConsumerMessage) error {
+	admitted := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	originals := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	keys := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		admittedMsg, key, err := p.admit(msg)
+		if err != nil {
+			return err
+		}
+		if admittedMsg == nil {
+			continue
+		}
+
+		// Keys are remembered once the batch is processed, so duplicates
+		// within the batch are skipped here.
+		if len(key) > 0 && contains(keys, key) {
+			skipDuplicate(msg)
+			continue
+		}
+		admitted = append(admitted, admittedMsg)
+		originals = append(originals, msg)
+		keys = append(keys, key)
+	}
+
+	if len(admitted) == 0 {
+		return nil
+	}
+	if err := p.deliver(batchMessage(admitted, p.config.BatchFormat), admitted, originals); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		p.dedup.Remember(key)
+	}
+	return nil
+}
+
+// admit returns the message to send to functions, decoded when
+// configured, or nil when it is skipped. Skipped messages are marked
+// as processed. The key the message is deduplicated by is returned to
+// be remembered once it is processed.
+func (p *processor) admit(msg *sarama.ConsumerMessage) (*sarama.ConsumerMessage, string, error) {
+	config := p.config
+
+	if len(msg.Value) == 0 && !config.ProcessEmpty {
+		emptyMessages.WithLabelValues(msg.Topic).Inc()
+		logEvent(levelDebug, "Skipping message with an empty value", logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		})
+		return nil, "", nil
+	}
+
+	if config.MaxMessageBytes > 0 && len(msg.Value) > config.MaxMessageBytes {
+		tooLarge := fmt.Errorf("message of %d bytes exceeds max_message_bytes of %d", len(msg.Value), config.MaxMessageBytes)
+		if len(config.DeadLetterTopic) > 0 {
+			if err := deadLetter(p.producer, config.DeadLetterTopic, msg, "", 0, tooLarge, nil); err != nil {
+				return nil, "", fmt.Errorf("unable to dead-letter message: %s", err)
+			}
+		}
+
+		logEvent(levelWarn, "Skipping message which is too large", logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"bytes":     len(msg.Value),
+		})
+		return nil, "", nil
+	}
+
+	// The original message is kept to be dead-lettered, the decoded
+	// one is filtered and sent to functions.
+	original := msg
+	if p.decoder != nil {
+		decoded, err := p.decoder.Decode(msg)
+		if err != nil {
+			if len(config.DeadLetterTopic) > 0 {
+				if dlqErr := deadLetter(p.producer, config.DeadLetterTopic, msg, "", 0, err, nil); dlqErr != nil {
+					return nil, "", fmt.Errorf("unable to dead-letter message: %s", dlqErr)
+				}
+			}
+
+			logEvent(levelWarn, "Skipping message which could not be decoded", logFields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"error":     err.Error(),
+			})
+			return nil, "", nil
+		}
+		msg = decoded
+	}
+
+	// Messages filtered out are marked as processed without invoking.
+	if !config.Filter.Match(msg) {
+		logEvent(levelDebug, "Skipping message which does not match the filter", logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		})
+		return nil, "", nil
+	}
+
+	key := p.dedup.Key(msg)
+	if p.dedup.Seen(key) {
+		skipDuplicate(msg)
+		return nil, "", nil
+	}
+
+	// The template is applied last so the filter and deduplication see
+	// the message before it is transformed.
+	if config.BodyTemplate != nil {
+		transformed, err := transformMessage(config.BodyTemplate, msg)
+		if err != nil {
+			if len(config.DeadLetterTopic) > 0 {
+				if dlqErr := deadLetter(p.producer, config.DeadLetterTopic, original, "", 0, err, nil); dlqErr != nil {
+					return nil, "", fmt.Errorf("unable to dead-letter message: %s", dlqErr)
+				}
+			}
+
+			logEvent(levelWarn, "Skipping message which could not be transformed", logFields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"error":     err.Error(),
+			})
+			return nil, "", nil
+		}
+		msg = transformed
+	}
+
+	if config.Envelope {
+		enveloped, err := envelopeMessage(msg)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to build the envelope: %s", err)
+		}
+		msg = enveloped
+	}
+
+	return msg, key, nil
+}
+
+// skipDuplicate counts and logs msg, which is skipped as a duplicate.
+func skipDuplicate(msg *sarama.ConsumerMessage) {
+	messagesDeduplicated.WithLabelValues(msg.Topic).Inc()
+	logEvent(levelDebug, "Skipping duplicate message", logFields{
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+	})
+}
+
+// deliver invokes the functions bound to the message's topic and
+// returns an error when any of them could not process the message.
+// Responses are published to the response topic and failed messages
+// to the dead-letter topic when they are set. When msg is a batch,
+// batch is its messages. The originals are the messages as they were
+// consumed, which are dead-lettered.
+func (p *processor) deliver(msg *sarama.ConsumerMessage, batch []*sarama.ConsumerMessage, originals []*sarama.ConsumerMessage) error {
+	config := p.config
+
+	functions := p.functions.Match(msg.Topic)
+	matchedFunctions.WithLabelValues(msg.Topic).Set(float64(len(functions)))
+	if len(functions) == 0 {
+		unboundMessages.WithLabelValues(msg.Topic).Inc()
+		if p.unbound.Allow(msg.Topic) {
+			logEvent(levelWarn, "No functions are bound to the topic, its messages are discarded", logFields{
+				"topic": msg.Topic,
+			})
+		}
+	}
+
+	if len(config.RouteHeader) > 0 {
+		functions = routeFunctions(msg, config.RouteHeader, functions)
+	}
+
+	var invokeErr error
+	for _, function := range functions {
+		// Messages which are not sampled are processed for the function
+		// without invoking it.
+		if !p.samplers.Sample(function, msg) {
+			logEvent(levelDebug, "Skipping message which was not sampled", logFields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"function":  function,
+			})
+			continue
+		}
+
+		var res types.InvokerResponse
+		var latency time.Duration
+
+		if generation, allowed := p.breakers.Allow(function); allowed {
+			start := time.Now()
+			res = p.invoker.Invoke(function, msg, len(batch))
+			latency = time.Since(start)
+			invocationDuration.WithLabelValues(function).Observe(latency.Seconds())
+			invocations.WithLabelValues(function).Inc()
+
+			// Only errors which suggest the function is unhealthy count
+			// towards opening its breaker, not 4xx statuses.
+			p.breakers.Result(function, generation, res.Error == nil && res.Status < http.StatusInternalServerError)
+
+			if p.responses != nil {
+				p.responses <- res
+			}
+		} else {
+			res = types.InvokerResponse{
+				Error:    fmt.Errorf("circuit breaker for %s is open", function),
+				Status:   http.StatusServiceUnavailable,
+				Function: function,
+				Topic:    msg.Topic,
+			}
+		}
+
+		failure := res.Error
+		if failure == nil && !config.SuccessStatusCodes.Match(res.Status) {
+			failure = fmt.Errorf("%s returned status %d", function, res.Status)
+		}
+
+		fields := logFields{
+			"topic":      msg.Topic,
+			"partition":  msg.Partition,
+			"offset":     msg.Offset,
+			"function":   function,
+			"status":     res.Status,
+			"latency_ms": latency.Nanoseconds() / int64(time.Millisecond),
+		}
+		if len(batch) > 0 {
+			fields["batch_size"] = len(batch)
+		}
+		if failure != nil {
+			fields["error"] = failure.Error()
+			logEvent(levelError, "Invocation failed", fields)
+		} else {
+			logEvent(levelInfo, "Invoked function", fields)
+		}
+
+		if p.status != nil || config.LogInvocations {
+			status := invocationStatus{
+				Function:  function,
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				BatchSize: len(batch),
+				Status:    res.Status,
+				LatencyMs: latency.Nanoseconds() / int64(time.Millisecond),
+				Success:   failure == nil,
+				Time:      time.Now(),
+			}
+			if failure != nil {
+				status.Error = failure.Error()
+			}
+			p.status.Publish(status)
+			if config.LogInvocations {
+				logInvocation(status)
+			}
+		}
+
+		if failure == nil {
+			if responseTopic := config.responseTopic(msg.Topic); len(responseTopic) > 0 {
+				if err := publishResponse(p.producer, responseTopic, msg, res, config.CopyHeaders, config.ForwardResponseHeaders); err != nil {
+					invokeErr = fmt.Errorf("unable to publish response from %s: %s", function, err)
+				}
+			}
+			continue
+		}
+		invocationFailures.WithLabelValues(function).Inc()
+
+		// A function which is still at capacity is no fault of the
+		// message so it is not dead-lettered, with at_least_once it is
+		// consumed again after a restart.
+		if len(config.DeadLetterTopic) == 0 || res.Status == http.StatusTooManyRequests {
+			invokeErr = failure
+			continue
+		}
+
+		var body []byte
+		if config.DeadLetterIncludeBody && res.Body != nil {
+			body = *res.Body
+			if len(body) > config.MaxDLQBodyBytes {
+				body = body[:config.MaxDLQBodyBytes]
+			}
+		}
+
+		for _, failedMsg := range originals {
+			if err := deadLetter(p.producer, config.DeadLetterTopic, failedMsg, function, res.Status, failure, body); err != nil {
+				invokeErr = fmt.Errorf("unable to dead-letter message for %s: %s", function, err)
+				break
+			}
+			logEvent(levelWarn, "Published message to dead-letter topic", logFields{
+				"topic":             failedMsg.Topic,
+				"partition":         failedMsg.Partition,
+				"offset":            failedMsg.Offset,
+				"function":          function,
+				"dead_letter_topic": config.DeadLetterTopic,
+			})
+		}
+	}
+	return invokeErr
+}
+
+// routeFunctions returns the functions of bound which are named in the
+// comma-separated header of msg, so a message can only be routed to
+// functions bound to its topic.
+func routeFunctions(msg *sarama.ConsumerMessage, header string, bound []string) []string {
+	routes := recordHeader(msg, header)
+
+	routed := []string{}
+	for _, function := range strings.Split(routes, ",") {
+		function = strings.TrimSpace(function)
+		if len(function) > 0 && contains(bound, function) && !contains(routed, function) {
+			routed = append(routed, function)
+		}
+	}
+
+	if len(routed) == 0 {
+		logEvent(levelDebug, "Skipping message which is not routed to any function bound to its topic", logFields{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"route":     routes,
+		})
+	}
+	return routed
+}
@@ -0,0 +1,467 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/openfaas-incubator/connector-sdk/types"
+)
+
+// fakeInvoker returns the statuses in order for each invocation, then
+// the last one for any further invocations. The batch size of each
+// invocation is recorded.
+type fakeInvoker struct {
+	statuses []int
+	lock     sync.Mutex
+	invoked  []string
+	batches  []int
+}
+
+func (f *fakeInvoker) Invoke(function string, msg *sarama.ConsumerMessage, batch int) types.InvokerResponse {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	status := f.statuses[len(f.statuses)-1]
+	if len(f.invoked) < len(f.statuses) {
+		status = f.statuses[len(f.invoked)]
+	}
+	f.invoked = append(f.invoked, function)
+	f.batches = append(f.batches, batch)
+
+	body := []byte("response")
+	return types.InvokerResponse{
+		Body:     &body,
+		Status:   status,
+		Function: function,
+		Topic:    msg.Topic,
+	}
+}
+
+type fakeMatcher map[string][]string
+
+func (f fakeMatcher) Match(topicName string) []string { return f[topicName] }
+
+// fakeMarker records the offsets marked on it and its commits.
+type fakeMarker struct {
+	lock    sync.Mutex
+	marked  []int64
+	commits int
+}
+
+func (f *fakeMarker) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.marked = append(f.marked, offset)
+}
+
+func (f *fakeMarker) CommitOffsets() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.commits++
+	return nil
+}
+
+// fakeProducer records the messages published with it.
+type fakeProducer struct {
+	lock      sync.Mutex
+	published []*sarama.ProducerMessage
+}
+
+func (f *fakeProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.published = append(f.published, msg)
+	return 0, int64(len(f.published)), nil
+}
+
+func (f *fakeProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		f.SendMessage(msg)
+	}
+	return nil
+}
+
+func (f *fakeProducer) Close() error { return nil }
+
+// processItem tracks and processes msg as the consumer loop does.
+func processItem(proc *processor, marker offsetMarker, msg *sarama.ConsumerMessage) {
+	item := consumed{msg: msg, consumer: marker}
+	proc.tracker.Add(item)
+	proc.Process([]consumed{item})
+}
+
+func Test_processor_MarksSuccessfulMessages(t *testing.T) {
+	config := testConfig(nil)
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing", "shipping"}}, nil, nil)
+
+	processItem(proc, marker, testMessage(10))
+
+	if len(invoker.invoked) != 2 {
+		t.Fatalf("want both functions invoked, got %v", invoker.invoked)
+	}
+	if len(marker.marked) != 1 || marker.marked[0] != 10 {
+		t.Fatalf("want offset 10 marked, got %v", marker.marked)
+	}
+	if marker.commits != 0 {
+		t.Fatalf("want no commits without manual_commit, got %d", marker.commits)
+	}
+}
+
+func Test_processor_MarksOffsetsInOrder(t *testing.T) {
+	config := testConfig(nil)
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	first := consumed{msg: testMessage(1), consumer: marker}
+	second := consumed{msg: testMessage(2), consumer: marker}
+	proc.tracker.Add(first)
+	proc.tracker.Add(second)
+
+	// The later message completes first, it is only marked once the
+	// earlier one has completed too.
+	proc.Process([]consumed{second})
+	if len(marker.marked) != 0 {
+		t.Fatalf("want nothing marked before offset 1 completes, got %v", marker.marked)
+	}
+
+	proc.Process([]consumed{first})
+	if len(marker.marked) != 1 || marker.marked[0] != 2 {
+		t.Fatalf("want offset 2 marked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_AtLeastOnce(t *testing.T) {
+	cases := []struct {
+		name        string
+		atLeastOnce string
+		wantMarked  bool
+	}{
+		{name: "failure is not marked", atLeastOnce: "true", wantMarked: false},
+		{name: "failure is marked without at_least_once", atLeastOnce: "false", wantMarked: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := testConfig(map[string]string{"at_least_once": c.atLeastOnce})
+			invoker := &fakeInvoker{statuses: []int{http.StatusInternalServerError}}
+			marker := &fakeMarker{}
+			proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+			processItem(proc, marker, testMessage(5))
+
+			if marked := len(marker.marked) > 0; marked != c.wantMarked {
+				t.Fatalf("want marked %t, got offsets %v", c.wantMarked, marker.marked)
+			}
+		})
+	}
+}
+
+func Test_processor_ManualCommit(t *testing.T) {
+	config := testConfig(map[string]string{"manual_commit": "true"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	processItem(proc, marker, testMessage(3))
+
+	if marker.commits != 1 {
+		t.Fatalf("want the offset committed once, got %d commits", marker.commits)
+	}
+}
+
+func Test_processor_DeadLettersFailedMessages(t *testing.T) {
+	config := testConfig(map[string]string{"dead_letter_topic": "orders-dlq"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusInternalServerError}}
+	marker := &fakeMarker{}
+	producer := &fakeProducer{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, producer, nil)
+
+	msg := testMessage(7)
+	msg.Key = []byte("order-1")
+	processItem(proc, marker, msg)
+
+	if len(producer.published) != 1 {
+		t.Fatalf("want 1 dead-lettered message, got %d", len(producer.published))
+	}
+	record := producer.published[0]
+	if record.Topic != "orders-dlq" {
+		t.Errorf("want topic orders-dlq, got %s", record.Topic)
+	}
+	if value, _ := record.Value.Encode(); string(value) != string(msg.Value) {
+		t.Errorf("want the original value, got %s", value)
+	}
+	if key, _ := record.Key.Encode(); string(key) != "order-1" {
+		t.Errorf("want the original key, got %s", key)
+	}
+
+	headers := map[string]string{}
+	for _, header := range record.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	want := map[string]string{
+		"x-original-topic":  "orders",
+		"x-original-offset": "7",
+		"x-function":        "billing",
+		"x-status-code":     "500",
+	}
+	for key, val := range want {
+		if headers[key] != val {
+			t.Errorf("want header %s=%s, got %q", key, val, headers[key])
+		}
+	}
+
+	// Once dead-lettered the message has been dealt with.
+	if len(marker.marked) != 1 || marker.marked[0] != 7 {
+		t.Fatalf("want offset 7 marked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_ThrottledMessagesAreNotDeadLettered(t *testing.T) {
+	config := testConfig(map[string]string{"dead_letter_topic": "orders-dlq"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusTooManyRequests}}
+	marker := &fakeMarker{}
+	producer := &fakeProducer{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, producer, nil)
+
+	processItem(proc, marker, testMessage(8))
+
+	if len(producer.published) != 0 {
+		t.Fatalf("want nothing dead-lettered, got %d messages", len(producer.published))
+	}
+	if len(marker.marked) != 0 {
+		t.Fatalf("want the offset left unmarked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_RetriesThroughGateway(t *testing.T) {
+	requests := 0
+	lock := sync.Mutex{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		attempt := requests
+		lock.Unlock()
+
+		if attempt <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	config := testConfig(map[string]string{
+		"gateway_url":            gateway.URL,
+		"max_retries":            "2",
+		"retry_initial_interval": "1ms",
+	})
+	invoker := gatewayInvoker{
+		client:   makeClient(time.Second, config),
+		limiters: newRateLimiters(config.RateLimit),
+		config:   config,
+	}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	processItem(proc, marker, testMessage(9))
+
+	if requests != 3 {
+		t.Fatalf("want 3 attempts, got %d", requests)
+	}
+	if len(marker.marked) != 1 || marker.marked[0] != 9 {
+		t.Fatalf("want offset 9 marked after the retries succeed, got %v", marker.marked)
+	}
+}
+
+func Test_processor_DeadLettersUndecodableMessages(t *testing.T) {
+	registry, _ := newTestRegistry(map[string]string{"1": `"string"`})
+	defer registry.Close()
+
+	config := testConfig(map[string]string{
+		"schema_registry_url": registry.URL,
+		"dead_letter_topic":   "orders-dlq",
+	})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	producer := &fakeProducer{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, producer, nil)
+
+	values := [][]byte{
+		append([]byte{1}, registryEncoded(1, avroString("paid"))[1:]...),
+		registryEncoded(9, avroString("paid")),
+	}
+	for i, value := range values {
+		msg := testMessage(int64(i))
+		msg.Value = value
+		processItem(proc, marker, msg)
+	}
+
+	if len(invoker.invoked) != 0 {
+		t.Fatalf("want no invocations, got %v", invoker.invoked)
+	}
+	if len(producer.published) != 2 {
+		t.Fatalf("want both messages dead-lettered, got %d", len(producer.published))
+	}
+	for i, record := range producer.published {
+		if value, _ := record.Value.Encode(); string(value) != string(values[i]) {
+			t.Errorf("want the undecoded value dead-lettered, got %v", value)
+		}
+	}
+	if len(marker.marked) != 2 {
+		t.Fatalf("want both offsets marked, got %v", marker.marked)
+	}
+
+	// A message in the registry's format is decoded and invoked.
+	msg := testMessage(2)
+	msg.Value = registryEncoded(1, avroString("paid"))
+	processItem(proc, marker, msg)
+	if len(invoker.invoked) != 1 {
+		t.Fatalf("want the decoded message invoked, got %v", invoker.invoked)
+	}
+}
+
+func Test_processor_MarksSuccessfulBatch(t *testing.T) {
+	config := testConfig(map[string]string{"batch_size": "3"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	items := []consumed{}
+	for offset := int64(1); offset <= 3; offset++ {
+		item := consumed{msg: testMessage(offset), consumer: marker}
+		proc.tracker.Add(item)
+		items = append(items, item)
+	}
+	proc.Process(items)
+
+	if len(invoker.invoked) != 1 {
+		t.Fatalf("want the batch invoked once, got %v", invoker.invoked)
+	}
+	if !reflect.DeepEqual(marker.marked, []int64{1, 2, 3}) {
+		t.Fatalf("want every offset of the batch marked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_DeadLettersEachMessageOfFailedBatch(t *testing.T) {
+	config := testConfig(map[string]string{
+		"batch_size":        "3",
+		"dead_letter_topic": "orders-dlq",
+	})
+	invoker := &fakeInvoker{statuses: []int{http.StatusInternalServerError}}
+	marker := &fakeMarker{}
+	producer := &fakeProducer{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, producer, nil)
+
+	items := []consumed{}
+	for offset := int64(1); offset <= 3; offset++ {
+		item := consumed{msg: testMessage(offset), consumer: marker}
+		proc.tracker.Add(item)
+		items = append(items, item)
+	}
+	proc.Process(items)
+
+	if len(producer.published) != 3 {
+		t.Fatalf("want each message of the batch dead-lettered, got %d", len(producer.published))
+	}
+	for i, record := range producer.published {
+		if value, _ := record.Value.Encode(); string(value) != `{"id":1}` {
+			t.Errorf("want message %d dead-lettered as it was consumed, got %s", i, value)
+		}
+	}
+	if !reflect.DeepEqual(marker.marked, []int64{1, 2, 3}) {
+		t.Fatalf("want every offset of the dead-lettered batch marked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_DedupSkipsProcessedMessages(t *testing.T) {
+	config := testConfig(map[string]string{"dedup_ttl": "1m"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	for offset := int64(1); offset <= 2; offset++ {
+		msg := testMessage(offset)
+		msg.Key = []byte("order-1")
+		processItem(proc, marker, msg)
+	}
+
+	if len(invoker.invoked) != 1 {
+		t.Fatalf("want the duplicate skipped, got %d invocations", len(invoker.invoked))
+	}
+	if len(marker.marked) != 2 {
+		t.Fatalf("want both offsets marked, got %v", marker.marked)
+	}
+}
+
+func Test_processor_DedupInvokesRedeliveredFailures(t *testing.T) {
+	cases := []struct {
+		name        string
+		vars        map[string]string
+		invocations int
+	}{
+		{
+			name:        "failed message is invoked again",
+			vars:        map[string]string{"dedup_ttl": "1m", "at_least_once": "true"},
+			invocations: 2,
+		},
+		{
+			name:        "dead-lettered message is a duplicate",
+			vars:        map[string]string{"dedup_ttl": "1m", "at_least_once": "true", "dead_letter_topic": "orders-dlq"},
+			invocations: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := testConfig(c.vars)
+			invoker := &fakeInvoker{statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+			proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, &fakeProducer{}, nil)
+
+			// The message is consumed again after the first delivery.
+			for i := 0; i < 2; i++ {
+				msg := testMessage(4)
+				msg.Key = []byte("order-1")
+				processItem(proc, &fakeMarker{}, msg)
+			}
+
+			if len(invoker.invoked) != c.invocations {
+				t.Fatalf("want %d invocations, got %d", c.invocations, len(invoker.invoked))
+			}
+		})
+	}
+}
+
+func Test_processor_DedupSkipsDuplicatesWithinBatch(t *testing.T) {
+	config := testConfig(map[string]string{"dedup_ttl": "1m", "batch_size": "3"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK}}
+	marker := &fakeMarker{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+
+	items := []consumed{}
+	for offset, key := range []string{"order-1", "order-2", "order-1"} {
+		msg := testMessage(int64(offset + 1))
+		msg.Key = []byte(key)
+		item := consumed{msg: msg, consumer: marker}
+		proc.tracker.Add(item)
+		items = append(items, item)
+	}
+	proc.Process(items)
+
+	if len(invoker.batches) != 1 || invoker.batches[0] != 2 {
+		t.Fatalf("want one batch of 2 messages, got %v", invoker.batches)
+	}
+	if len(marker.marked) != 3 {
+		t.Fatalf("want every offset marked, got %v", marker.marked)
+	}
+}
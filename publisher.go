@@ -0,0 +1,150 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/openfaas-incubator/connector-sdk/types"
+)
+
+// makeProducer creates a producer for publishing records back to the
+// brokers the connector consumes from.
+func makeProducer(brokers []string, config connectorConfig) (sarama.SyncProducer, error) {
+	pConfig := sarama.NewConfig()
+	pConfig.Version = config.KafkaVersion
+	pConfig.ClientID = config.ClientID
+	pConfig.Producer.Return.Successes = true
+	pConfig.Producer.RequiredAcks = config.ProducerAcks
+	pConfig.Producer.Retry.Max = config.ProducerRetries
+	if config.ProducerIdempotent {
+		// Sarama only keeps records in order for an idempotent producer
+		// with one request in flight per broker.
+		pConfig.Producer.Idempotent = true
+		pConfig.Net.MaxOpenRequests = 1
+	}
+	applySASL(pConfig, config)
+	applyTLS(pConfig, config)
+
+	producer, err := sarama.NewSyncProducer(brokers, pConfig)
+	if err != nil {
+		return nil, err
+	}
+	return withHeaders(producer, config.KafkaVersion), nil
+}
+
+// headerlessProducer drops the headers of every record it publishes,
+// Sarama refuses to produce headers to brokers older than 0.11.
+type headerlessProducer struct {
+	sarama.SyncProducer
+}
+
+// withHeaders returns producer when version supports record headers,
+// otherwise records are published without them.
+func withHeaders(producer sarama.SyncProducer, version sarama.KafkaVersion) sarama.SyncProducer {
+	if version.IsAtLeast(sarama.V0_11_0_0) {
+		return producer
+	}
+	return headerlessProducer{producer}
+}
+
+func (p headerlessProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	msg.Headers = nil
+	return p.SyncProducer.SendMessage(msg)
+}
+
+func (p headerlessProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		msg.Headers = nil
+	}
+	return p.SyncProducer.SendMessages(msgs)
+}
+
+// deadLetter publishes a message which a function failed to process to
+// the dead-letter topic. The original key, value and headers are kept
+// and the reason for the failure is added as headers, along with the
+// function's response body when it is not empty.
+func deadLetter(producer sarama.SyncProducer, topic string, msg *sarama.ConsumerMessage, function string, status int, cause error, body []byte) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+7)
+	for _, header := range msg.Headers {
+		headers = append(headers, *header)
+	}
+
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte("x-original-topic"), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte("x-original-partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte("x-original-offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		sarama.RecordHeader{Key: []byte("x-function"), Value: []byte(function)},
+		sarama.RecordHeader{Key: []byte("x-status-code"), Value: []byte(strconv.Itoa(status))},
+		sarama.RecordHeader{Key: []byte("x-error"), Value: []byte(cause.Error())},
+	)
+	if len(body) > 0 {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("x-response-body"), Value: body})
+	}
+
+	record := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if msg.Key != nil {
+		record.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	_, _, err := producer.SendMessage(record)
+	return err
+}
+
+// publishResponse publishes the body of a function's response to the
+// response topic, keyed by the key of the message which triggered it.
+// The message's position and the headers named in copyHeaders are added
+// so the response can be correlated with it, along with the response
+// headers named in responseHeaders.
+func publishResponse(producer sarama.SyncProducer, topic string, msg *sarama.ConsumerMessage, res types.InvokerResponse, copyHeaders, responseHeaders []string) error {
+	headers := []sarama.RecordHeader{
+		{Key: []byte("x-function"), Value: []byte(res.Function)},
+		{Key: []byte("x-status-code"), Value: []byte(strconv.Itoa(res.Status))},
+		{Key: []byte("x-source-topic"), Value: []byte(msg.Topic)},
+		{Key: []byte("x-source-partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		{Key: []byte("x-source-offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	}
+	if !msg.Timestamp.IsZero() {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("x-source-timestamp"), Value: []byte(msg.Timestamp.Format(time.RFC3339Nano))})
+	}
+
+	for _, header := range msg.Headers {
+		for _, name := range copyHeaders {
+			if strings.EqualFold(string(header.Key), name) {
+				headers = append(headers, *header)
+				break
+			}
+		}
+	}
+
+	if res.Header != nil {
+		for _, name := range responseHeaders {
+			for _, value := range (*res.Header)[http.CanonicalHeaderKey(name)] {
+				headers = append(headers, sarama.RecordHeader{Key: []byte(strings.ToLower(name)), Value: []byte(value)})
+			}
+		}
+	}
+
+	record := &sarama.ProducerMessage{
+		Topic:   topic,
+		Headers: headers,
+	}
+	if res.Body != nil {
+		record.Value = sarama.ByteEncoder(*res.Body)
+	}
+	if msg.Key != nil {
+		record.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	_, _, err := producer.SendMessage(record)
+	return err
+}
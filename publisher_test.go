@@ -0,0 +1,117 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/openfaas-incubator/connector-sdk/types"
+)
+
+// newTestBroker starts a broker which leads partition 0 of topic and
+// accepts every record produced to it.
+func newTestBroker(t *testing.T, topic string, version sarama.KafkaVersion) *sarama.MockBroker {
+	// The produce response must be encoded with the version of the
+	// request Sarama sends for the configured kafka_version.
+	produceVersion := int16(2)
+	if version.IsAtLeast(sarama.V0_11_0_0) {
+		produceVersion = 3
+	}
+
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(produceVersion),
+	})
+	return broker
+}
+
+func Test_deadLetter_KafkaVersions(t *testing.T) {
+	for _, version := range []string{"0.10.2.0", "0.11.0.0", "2.1.0"} {
+		t.Run(version, func(t *testing.T) {
+			config := testConfig(map[string]string{
+				"kafka_version":     version,
+				"dead_letter_topic": "orders-dlq",
+			})
+			broker := newTestBroker(t, "orders-dlq", config.KafkaVersion)
+			defer broker.Close()
+
+			producer, err := makeProducer([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer producer.Close()
+
+			msg := testMessage(7)
+			msg.Headers = []*sarama.RecordHeader{{Key: []byte("tenant"), Value: []byte("acme")}}
+			cause := errors.New("billing returned status 500")
+			if err := deadLetter(producer, config.DeadLetterTopic, msg, "billing", http.StatusInternalServerError, cause, nil); err != nil {
+				t.Fatalf("want the message dead-lettered with kafka_version %s, got: %s", version, err)
+			}
+		})
+	}
+}
+
+func Test_withHeaders_DropsHeadersBefore0_11(t *testing.T) {
+	cases := []struct {
+		version string
+		headers bool
+	}{
+		{version: "0.10.2.0", headers: false},
+		{version: "0.11.0.0", headers: true},
+	}
+
+	for _, c := range cases {
+		config := testConfig(map[string]string{"kafka_version": c.version})
+		record := &sarama.ProducerMessage{
+			Topic:   "orders-dlq",
+			Headers: []sarama.RecordHeader{{Key: []byte("x-function"), Value: []byte("billing")}},
+		}
+
+		producer := &fakeProducer{}
+		if _, _, err := withHeaders(producer, config.KafkaVersion).SendMessage(record); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(producer.published) != 1 {
+			t.Fatalf("%s: want the record published, got %d", c.version, len(producer.published))
+		}
+		if got := producer.published[0].Headers != nil; got != c.headers {
+			t.Errorf("%s: want headers %t, got %v", c.version, c.headers, producer.published[0].Headers)
+		}
+	}
+}
+
+func Test_publishResponse_KafkaVersions(t *testing.T) {
+	for _, version := range []string{"0.10.2.0", "0.11.0.0", "2.1.0"} {
+		t.Run(version, func(t *testing.T) {
+			config := testConfig(map[string]string{
+				"kafka_version":  version,
+				"response_topic": "orders-processed",
+				"copy_headers":   "tenant",
+			})
+			broker := newTestBroker(t, "orders-processed", config.KafkaVersion)
+			defer broker.Close()
+
+			producer, err := makeProducer([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer producer.Close()
+
+			msg := testMessage(7)
+			msg.Headers = []*sarama.RecordHeader{{Key: []byte("tenant"), Value: []byte("acme")}}
+			body := []byte(`{"status":"paid"}`)
+			res := types.InvokerResponse{Function: "billing", Status: http.StatusOK, Body: &body}
+			if err := publishResponse(producer, config.ResponseTopic, msg, res, config.CopyHeaders, nil); err != nil {
+				t.Fatalf("want the response published with kafka_version %s, got: %s", version, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimit is the number of invocations per second a function may
+// receive along with the burst allowed above it, a limit of 0 is
+// unlimited.
+type rateLimit struct {
+	Limit float64
+	Burst int
+}
+
+// rateLimiters limits the rate at which each function is invoked to
+// the configured default or to the limit set by its annotations.
+type rateLimiters struct {
+	defaultLimit rateLimit
+	overrides    map[string]rateLimit
+	limiters     map[string]*rate.Limiter
+	lock         sync.Mutex
+}
+
+func newRateLimiters(defaultLimit rateLimit) *rateLimiters {
+	return &rateLimiters{
+		defaultLimit: defaultLimit,
+		overrides:    make(map[string]rateLimit),
+		limiters:     make(map[string]*rate.Limiter),
+	}
+}
+
+// Wait blocks until function may be invoked or ctx is done, in which
+// case the context's error is returned.
+func (r *rateLimiters) Wait(ctx context.Context, function string) error {
+	limiter := r.limiter(function)
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func (r *rateLimiters) limiter(function string) *rate.Limiter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	limit := r.limitFor(function)
+	if limit.Limit <= 0 {
+		delete(r.limiters, function)
+		return nil
+	}
+
+	limiter, ok := r.limiters[function]
+	if !ok || limiter.Burst() != limit.Burst {
+		limiter = rate.NewLimiter(rate.Limit(limit.Limit), limit.Burst)
+		r.limiters[function] = limiter
+	} else if limiter.Limit() != rate.Limit(limit.Limit) {
+		limiter.SetLimit(rate.Limit(limit.Limit))
+	}
+
+	return limiter
+}
+
+func (r *rateLimiters) limitFor(function string) rateLimit {
+	if limit, ok := r.overrides[function]; ok {
+		return limit
+	}
+	return r.defaultLimit
+}
+
+// Sync replaces the per-function limits read from annotations, the
+// limiters pick up the new limits on their next use.
+func (r *rateLimiters) Sync(overrides map[string]rateLimit) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.overrides = overrides
+}
+
+// parseRateLimit reads a function's rate_limit and rate_burst
+// annotations on top of the default limit, it returns false when
+// neither is set or they are invalid.
+func parseRateLimit(annotations map[string]string, defaultLimit rateLimit) (rateLimit, bool) {
+	limit := defaultLimit
+	found := false
+
+	if val, ok := annotations["rate_limit"]; ok {
+		parsedVal, err := strconv.ParseFloat(val, 64)
+		if err != nil || parsedVal < 0 {
+			return limit, false
+		}
+		limit.Limit = parsedVal
+		limit.Burst = burstFor(parsedVal)
+		found = true
+	}
+
+	if val, ok := annotations["rate_burst"]; ok {
+		parsedVal, err := strconv.Atoi(val)
+		if err != nil || parsedVal <= 0 {
+			return limit, false
+		}
+		limit.Burst = parsedVal
+		found = true
+	}
+
+	return limit, found
+}
+
+// burstFor returns the default burst for a limit, which allows a
+// second's worth of invocations at once and at least one.
+func burstFor(limit float64) int {
+	if limit < 1 {
+		return 1
+	}
+	return int(limit)
+}
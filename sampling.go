@@ -0,0 +1,85 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// samplers decides which messages are sent to functions which set the
+// sample_rate annotation, functions without it receive every message.
+type samplers struct {
+	// sticky samples by a hash of the message key so each key is either
+	// always or never sent to a function
+	sticky bool
+
+	rates map[string]float64
+	lock  sync.Mutex
+
+	// The annotations are read on every rebuild of the topic map, so an
+	// invalid sample_rate is logged once a minute per function.
+	invalid *logThrottle
+}
+
+func newSamplers(sticky bool) *samplers {
+	return &samplers{
+		sticky:  sticky,
+		rates:   make(map[string]float64),
+		invalid: newLogThrottle(time.Minute),
+	}
+}
+
+// Sample reports whether msg should be sent to function. Messages
+// without a key are sampled at random even when sampling is sticky.
+func (s *samplers) Sample(function string, msg *sarama.ConsumerMessage) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lock.Lock()
+	rate, ok := s.rates[function]
+	s.lock.Unlock()
+
+	if !ok || rate >= 1 {
+		return true
+	}
+
+	if s.sticky && len(msg.Key) > 0 {
+		h := fnv.New32a()
+		h.Write(msg.Key)
+		return float64(h.Sum32()) < rate*math.MaxUint32
+	}
+	return rand.Float64() < rate
+}
+
+// Sync replaces the per-function sample rates read from annotations.
+func (s *samplers) Sync(rates map[string]float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rates = rates
+}
+
+// parseSampleRate reads a function's sample_rate annotation, it returns
+// false when it is not set and an error when it is not between 0 and 1.
+func parseSampleRate(annotations map[string]string) (float64, bool, error) {
+	val, ok := annotations["sample_rate"]
+	if !ok {
+		return 0, false, nil
+	}
+
+	parsedVal, err := strconv.ParseFloat(val, 64)
+	if err != nil || parsedVal < 0 || parsedVal > 1 {
+		return 0, false, fmt.Errorf("sample_rate %q is not valid, it must be a number between 0 and 1", val)
+	}
+	return parsedVal, true, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_parseSampleRate(t *testing.T) {
+	cases := []struct {
+		name  string
+		val   string
+		unset bool
+		rate  float64
+		ok    bool
+		isErr bool
+	}{
+		{name: "not set", unset: true},
+		{name: "a fraction", val: "0.25", rate: 0.25, ok: true},
+		{name: "none", val: "0", rate: 0, ok: true},
+		{name: "all", val: "1", rate: 1, ok: true},
+		{name: "a percentage", val: "10%", isErr: true},
+		{name: "above 1", val: "1.5", isErr: true},
+		{name: "negative", val: "-0.1", isErr: true},
+		{name: "empty", val: "", isErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if !c.unset {
+				annotations["sample_rate"] = c.val
+			}
+
+			rate, ok, err := parseSampleRate(annotations)
+			if (err != nil) != c.isErr {
+				t.Fatalf("want error %t, got %v", c.isErr, err)
+			}
+			if ok != c.ok || rate != c.rate {
+				t.Fatalf("want rate %v and ok %t, got %v and %t", c.rate, c.ok, rate, ok)
+			}
+		})
+	}
+}
+
+// sampled returns how many of n messages with distinct keys are sampled
+// for function.
+func sampled(s *samplers, function string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		msg := testMessage(int64(i))
+		msg.Key = []byte(fmt.Sprintf("order-%d", i))
+		if s.Sample(function, msg) {
+			count++
+		}
+	}
+	return count
+}
+
+func Test_samplers_Rates(t *testing.T) {
+	for _, sticky := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sticky %t", sticky), func(t *testing.T) {
+			s := newSamplers(sticky)
+			s.Sync(map[string]float64{"none": 0, "half": 0.5, "all": 1})
+
+			if n := sampled(s, "none", 1000); n != 0 {
+				t.Errorf("want nothing sampled at 0, got %d", n)
+			}
+			if n := sampled(s, "all", 1000); n != 1000 {
+				t.Errorf("want everything sampled at 1, got %d", n)
+			}
+			if n := sampled(s, "unannotated", 1000); n != 1000 {
+				t.Errorf("want everything sampled without a rate, got %d", n)
+			}
+			if n := sampled(s, "half", 10000); n < 4000 || n > 6000 {
+				t.Errorf("want around half sampled at 0.5, got %d of 10000", n)
+			}
+		})
+	}
+
+	// Sampling is disabled with nil samplers.
+	var disabled *samplers
+	if n := sampled(disabled, "half", 100); n != 100 {
+		t.Errorf("want everything sampled with nil samplers, got %d", n)
+	}
+}
+
+func Test_samplers_StickyByKey(t *testing.T) {
+	s := newSamplers(true)
+	s.Sync(map[string]float64{"canary": 0.5})
+
+	for i := 0; i < 100; i++ {
+		msg := testMessage(int64(i))
+		msg.Key = []byte(fmt.Sprintf("order-%d", i))
+
+		first := s.Sample("canary", msg)
+		for j := 0; j < 10; j++ {
+			if s.Sample("canary", msg) != first {
+				t.Fatalf("want key %s always or never sampled", msg.Key)
+			}
+		}
+	}
+
+	// Messages without a key are sampled at random.
+	keyless := 0
+	for i := 0; i < 10000; i++ {
+		if s.Sample("canary", testMessage(int64(i))) {
+			keyless++
+		}
+	}
+	if keyless < 4000 || keyless > 6000 {
+		t.Errorf("want around half of the keyless messages sampled, got %d of 10000", keyless)
+	}
+}
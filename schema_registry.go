@@ -0,0 +1,125 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// avroDecoder decodes the keys and values of messages written in the
+// Confluent Schema Registry's wire format, a zero magic byte and a
+// 4-byte schema ID followed by the Avro data, to JSON. Schemas are
+// fetched from the registry once and cached by ID.
+type avroDecoder struct {
+	registryURL string
+	client      *http.Client
+	key         bool
+	value       bool
+
+	schemas map[uint32]*avroSchema
+	lock    sync.Mutex
+}
+
+func newAvroDecoder(registryURL string, key, value bool) *avroDecoder {
+	return &avroDecoder{
+		registryURL: strings.TrimSuffix(registryURL, "/"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		key:         key,
+		value:       value,
+		schemas:     make(map[uint32]*avroSchema),
+	}
+}
+
+// Decode returns a copy of msg with its key and value decoded to JSON
+// as configured, an empty key or value is left as it is.
+func (d *avroDecoder) Decode(msg *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	decoded := *msg
+
+	if d.key && len(msg.Key) > 0 {
+		key, err := d.decode(msg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key: %s", err)
+		}
+		decoded.Key = key
+	}
+
+	if d.value && len(msg.Value) > 0 {
+		value, err := d.decode(msg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode value: %s", err)
+		}
+		decoded.Value = value
+	}
+
+	return &decoded, nil
+}
+
+func (d *avroDecoder) decode(data []byte) ([]byte, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, fmt.Errorf("data is not in the schema registry format")
+	}
+
+	schema, err := d.schema(binary.BigEndian.Uint32(data[1:5]))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decodeAvro(schema, data[5:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// schema returns the schema with the given ID, fetching it from the
+// registry if it has not been seen before. The lock is held while
+// fetching so a schema is only fetched once.
+func (d *avroDecoder) schema(id uint32) (*avroSchema, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if schema, ok := d.schemas[id]; ok {
+		return schema, nil
+	}
+
+	schemaURL := fmt.Sprintf("%s/schemas/ids/%d", d.registryURL, id)
+	res, err := d.client.Get(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", schemaURL, res.StatusCode)
+	}
+
+	registered := struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}{}
+	if err := json.Unmarshal(body, &registered); err != nil {
+		return nil, fmt.Errorf("unable to parse schema %d: %s", id, err)
+	}
+	if len(registered.SchemaType) > 0 && registered.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("schema %d is %s, only Avro is supported", id, registered.SchemaType)
+	}
+
+	schema, err := parseAvroSchema(registered.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse schema %d: %s", id, err)
+	}
+
+	d.schemas[id] = schema
+	return schema, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// newTestRegistry serves the schemas by their ID, it returns the number
+// of times each was fetched.
+func newTestRegistry(schemas map[string]string) (*httptest.Server, func(id string) int) {
+	lock := sync.Mutex{}
+	fetches := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/schemas/ids/")
+
+		lock.Lock()
+		fetches[id]++
+		lock.Unlock()
+
+		schema, ok := schemas[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+	}))
+
+	return server, func(id string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return fetches[id]
+	}
+}
+
+// registryEncoded prefixes data with the magic byte and schema ID of the
+// schema registry's wire format.
+func registryEncoded(id uint32, data []byte) []byte {
+	encoded := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(encoded[1:], id)
+	return append(encoded, data...)
+}
+
+const testOrderSchema = `{"type":"record","name":"Order","fields":[{"name":"id","type":"long"},{"name":"sku","type":"string"}]}`
+
+func Test_avroDecoder_CachesSchemasByID(t *testing.T) {
+	registry, fetches := newTestRegistry(map[string]string{
+		"1": testOrderSchema,
+		"2": `"string"`,
+	})
+	defer registry.Close()
+
+	decoder := newAvroDecoder(registry.URL+"/", true, true)
+
+	for i := int64(0); i < 3; i++ {
+		msg := &sarama.ConsumerMessage{
+			Topic: "orders",
+			Key:   registryEncoded(2, avroString("order-1")),
+			Value: registryEncoded(1, avroData(avroLong(i), avroString("a-1"))),
+		}
+
+		decoded, err := decoder.Decode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded.Key) != `"order-1"` {
+			t.Errorf("want the key decoded to JSON, got %s", decoded.Key)
+		}
+		if want := fmt.Sprintf(`{"id":%d,"sku":"a-1"}`, i); string(decoded.Value) != want {
+			t.Errorf("want the value decoded to %s, got %s", want, decoded.Value)
+		}
+
+		// The consumed message is left as it was.
+		if msg.Value[0] != 0 {
+			t.Errorf("want the original message unchanged")
+		}
+	}
+
+	if fetches("1") != 1 || fetches("2") != 1 {
+		t.Fatalf("want each schema fetched once, got %d and %d", fetches("1"), fetches("2"))
+	}
+}
+
+func Test_avroDecoder_OnlyDecodesAsConfigured(t *testing.T) {
+	registry, _ := newTestRegistry(map[string]string{"1": `"string"`})
+	defer registry.Close()
+
+	decoder := newAvroDecoder(registry.URL, false, true)
+	key := []byte("order-1")
+	msg := &sarama.ConsumerMessage{Key: key, Value: registryEncoded(1, avroString("paid"))}
+
+	decoded, err := decoder.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Key) != "order-1" {
+		t.Errorf("want the key left as it is, got %s", decoded.Key)
+	}
+	if string(decoded.Value) != `"paid"` {
+		t.Errorf("want the value decoded, got %s", decoded.Value)
+	}
+}
+
+func Test_avroDecoder_Invalid(t *testing.T) {
+	registry, fetches := newTestRegistry(map[string]string{
+		"1": testOrderSchema,
+		"3": `{"type":"record"}`,
+	})
+	defer registry.Close()
+
+	cases := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "too short", value: []byte{0, 0, 1}},
+		{name: "wrong magic byte", value: append([]byte{1}, registryEncoded(1, nil)[1:]...)},
+		{name: "plain JSON", value: []byte(`{"id":1,"sku":"a-1"}`)},
+		{name: "unknown schema ID", value: registryEncoded(9, avroLong(1))},
+		{name: "invalid schema", value: registryEncoded(3, avroLong(1))},
+		{name: "data doesn't match the schema", value: registryEncoded(1, avroLong(1))},
+	}
+
+	decoder := newAvroDecoder(registry.URL, false, true)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if decoded, err := decoder.Decode(&sarama.ConsumerMessage{Value: c.value}); err == nil {
+				t.Errorf("want an error, got %s", decoded.Value)
+			}
+		})
+	}
+
+	// Schemas which could not be fetched are not cached.
+	decoder.Decode(&sarama.ConsumerMessage{Value: registryEncoded(9, avroLong(1))})
+	if fetches("9") != 2 {
+		t.Errorf("want the unknown schema fetched again, got %d fetches", fetches("9"))
+	}
+}
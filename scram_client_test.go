@@ -0,0 +1,147 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// setEnv sets the env-vars in vars, returning a function which restores
+// their previous values.
+func setEnv(vars map[string]string) func() {
+	previous := map[string]*string{}
+	for key, val := range vars {
+		if old, exists := os.LookupEnv(key); exists {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		os.Setenv(key, val)
+	}
+
+	return func() {
+		for key, old := range previous {
+			if old == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *old)
+			}
+		}
+	}
+}
+
+func Test_applySASL_SCRAMClientAuthenticates(t *testing.T) {
+	cases := []struct {
+		mechanism string
+		hash      scram.HashGeneratorFcn
+	}{
+		{mechanism: sarama.SASLTypeSCRAMSHA256, hash: SHA256},
+		{mechanism: sarama.SASLTypeSCRAMSHA512, hash: SHA512},
+	}
+
+	for _, c := range cases {
+		t.Run(c.mechanism, func(t *testing.T) {
+			sConfig := sarama.NewConfig()
+			applySASL(sConfig, connectorConfig{
+				SASLUser:      "connector",
+				SASLPassword:  "secret",
+				SASLMechanism: c.mechanism,
+			})
+
+			if !sConfig.Net.SASL.Enable {
+				t.Fatalf("want SASL enabled")
+			}
+			if sConfig.Net.SASL.SCRAMClientGeneratorFunc == nil {
+				t.Fatalf("want a SCRAM client generator for %s", c.mechanism)
+			}
+
+			// The broker's side of the exchange, with the credentials
+			// stored for the user.
+			stored, err := c.hash.NewClient("connector", "secret", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			credentials := stored.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+			server, err := c.hash.NewServer(func(user string) (scram.StoredCredentials, error) {
+				return credentials, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverConv := server.NewConversation()
+
+			client := sConfig.Net.SASL.SCRAMClientGeneratorFunc()
+			if err := client.Begin(sConfig.Net.SASL.User, sConfig.Net.SASL.Password, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			challenge := ""
+			for !client.Done() {
+				response, err := client.Step(challenge)
+				if err != nil {
+					t.Fatalf("client step: %s", err)
+				}
+				if client.Done() {
+					break
+				}
+				if challenge, err = serverConv.Step(response); err != nil {
+					t.Fatalf("server step: %s", err)
+				}
+			}
+
+			if !serverConv.Valid() {
+				t.Fatalf("want the server to accept the client's proof")
+			}
+		})
+	}
+}
+
+func Test_buildConnectorConfig_UnknownSASLMechanism(t *testing.T) {
+	// An invalid configuration exits the process, so it is built in a
+	// copy of the test binary.
+	if os.Getenv("TEST_BUILD_CONNECTOR_CONFIG") == "1" {
+		buildConnectorConfig()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_buildConnectorConfig_UnknownSASLMechanism$")
+	cmd.Env = append(os.Environ(),
+		"TEST_BUILD_CONNECTOR_CONFIG=1",
+		"topics=faas-request",
+		"sasl_user=connector",
+		"sasl_mechanism=SCRAM-SHA-1",
+	)
+	output, err := cmd.CombinedOutput()
+
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+		t.Fatalf("want the process to exit for an unknown sasl_mechanism, got: %v", err)
+	}
+	if !strings.Contains(string(output), `sasl_mechanism "SCRAM-SHA-1"`) {
+		t.Fatalf("want the error to name sasl_mechanism, got: %s", output)
+	}
+}
+
+func Test_buildConnectorConfig_SCRAMMechanisms(t *testing.T) {
+	for _, mechanism := range []string{sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512} {
+		t.Run(mechanism, func(t *testing.T) {
+			defer setEnv(map[string]string{
+				"topics":         "faas-request",
+				"sasl_user":      "connector",
+				"sasl_password":  "secret",
+				"sasl_mechanism": mechanism,
+			})()
+
+			config := buildConnectorConfig()
+			if config.SASLMechanism != mechanism {
+				t.Fatalf("want SASLMechanism %s, got %s", mechanism, config.SASLMechanism)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// invocationStatus is the record published to the status topic for each
+// invocation, it describes the invocation without the message or the
+// function's response.
+type invocationStatus struct {
+	Function  string    `json:"function"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	BatchSize int       `json:"batch_size"`
+	Status    int       `json:"status"`
+	LatencyMs int64     `json:"latency_ms"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// statusPublisher publishes invocation statuses to the status topic in
+// batches of up to size records, partial batches are published every
+// interval.
+type statusPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+	size     int
+	interval time.Duration
+
+	records chan *sarama.ProducerMessage
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newStatusPublisher(producer sarama.SyncProducer, topic string, size int, interval time.Duration) *statusPublisher {
+	s := &statusPublisher{
+		producer: producer,
+		topic:    topic,
+		size:     size,
+		interval: interval,
+		records:  make(chan *sarama.ProducerMessage, size),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Publish queues status to be published, keyed by the function so the
+// statuses of each function stay in order. It blocks while a full batch
+// is waiting to be published and does nothing when s is nil or closed,
+// such as for invocations abandoned on shutdown.
+func (s *statusPublisher) Publish(status invocationStatus) {
+	if s == nil {
+		return
+	}
+
+	value, err := json.Marshal(status)
+	if err != nil {
+		logEvent(levelError, "Unable to encode invocation status", logFields{"error": err.Error()})
+		return
+	}
+
+	record := &sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(status.Function),
+		Value: sarama.ByteEncoder(value),
+	}
+	select {
+	case s.records <- record:
+	case <-s.stop:
+	}
+}
+
+// Close publishes the queued statuses then returns.
+func (s *statusPublisher) Close() {
+	if s == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+}
+
+func (s *statusPublisher) run() {
+	defer close(s.done)
+
+	batch := make([]*sarama.ProducerMessage, 0, s.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.producer.SendMessages(batch); err != nil {
+			logEvent(levelError, "Unable to publish invocation statuses", logFields{
+				"status_topic": s.topic,
+				"statuses":     len(batch),
+				"error":        err.Error(),
+			})
+		}
+		batch = make([]*sarama.ProducerMessage, 0, s.size)
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record := <-s.records:
+			batch = append(batch, record)
+			if len(batch) >= s.size {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-s.stop:
+			for len(s.records) > 0 {
+				batch = append(batch, <-s.records)
+				if len(batch) >= s.size {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_statusPublisher_PublishesInvocations(t *testing.T) {
+	config := testConfig(map[string]string{"status_topic": "invocations"})
+	invoker := &fakeInvoker{statuses: []int{http.StatusOK, http.StatusInternalServerError}}
+	producer := &fakeProducer{}
+	proc := newProcessor(config, invoker, fakeMatcher{"orders": {"billing"}}, nil, nil)
+	proc.status = newStatusPublisher(producer, config.StatusTopic, config.StatusBatchSize, time.Minute)
+
+	before := time.Now()
+	processItem(proc, &fakeMarker{}, testMessage(4))
+	processItem(proc, &fakeMarker{}, testMessage(5))
+
+	// The partial batch is published on close.
+	proc.status.Close()
+
+	if len(producer.published) != 2 {
+		t.Fatalf("want a status for each invocation, got %d", len(producer.published))
+	}
+
+	statuses := []invocationStatus{}
+	for _, record := range producer.published {
+		if record.Topic != "invocations" {
+			t.Errorf("want topic invocations, got %s", record.Topic)
+		}
+		if key, _ := record.Key.Encode(); string(key) != "billing" {
+			t.Errorf("want the record keyed by function, got %s", key)
+		}
+
+		value, _ := record.Value.Encode()
+		status := invocationStatus{}
+		if err := json.Unmarshal(value, &status); err != nil {
+			t.Fatalf("want a JSON status, got %s", value)
+		}
+		statuses = append(statuses, status)
+	}
+
+	success, failure := statuses[0], statuses[1]
+	if success.Function != "billing" || success.Topic != "orders" || success.Partition != 0 || success.Offset != 4 {
+		t.Errorf("want the success to describe the message, got %+v", success)
+	}
+	if success.Status != http.StatusOK || !success.Success || len(success.Error) > 0 || success.BatchSize != 0 {
+		t.Errorf("want a successful status, got %+v", success)
+	}
+	if success.Time.Before(before.Add(-time.Second)) || success.LatencyMs < 0 {
+		t.Errorf("want the time and latency of the invocation, got %s and %d", success.Time, success.LatencyMs)
+	}
+
+	if failure.Offset != 5 || failure.Status != http.StatusInternalServerError || failure.Success {
+		t.Errorf("want a failed status, got %+v", failure)
+	}
+	if failure.Error != "billing returned status 500" {
+		t.Errorf("want the failure's error, got %q", failure.Error)
+	}
+}
+
+func Test_statusPublisher_PublishesInBatches(t *testing.T) {
+	producer := &fakeProducer{}
+	publisher := newStatusPublisher(producer, "invocations", 2, time.Minute)
+
+	for offset := int64(0); offset < 5; offset++ {
+		publisher.Publish(invocationStatus{Function: "billing", Offset: offset})
+	}
+	publisher.Close()
+
+	if len(producer.published) != 5 {
+		t.Fatalf("want every status published, got %d", len(producer.published))
+	}
+	for i, record := range producer.published {
+		value, _ := record.Value.Encode()
+		status := invocationStatus{}
+		json.Unmarshal(value, &status)
+		if status.Offset != int64(i) {
+			t.Errorf("want statuses published in order, got offset %d at %d", status.Offset, i)
+		}
+	}
+
+	// Statuses of invocations finishing after close are dropped.
+	publisher.Publish(invocationStatus{Function: "billing"})
+	if len(producer.published) != 5 {
+		t.Fatalf("want nothing published after close, got %d", len(producer.published))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// subscription returns the topics to consume when they are derived from
+// the topic map: the static topics along with every topic a function is
+// bound to by name, and an expression matching the topics functions are
+// bound to with topic_regex and pattern when it is set, or nil when there
+// are none.
+func subscription(static []string, pattern *regexp.Regexp, topicMap *TopicMap) ([]string, *regexp.Regexp) {
+	seen := map[string]bool{}
+	topics := []string{}
+	expressions := []string{}
+
+	add := func(topic string) {
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+
+	for _, topic := range static {
+		add(topic)
+	}
+
+	if pattern != nil {
+		expressions = append(expressions, pattern.String())
+	}
+
+	for _, topic := range topicMap.Topics() {
+		if strings.HasPrefix(topic, regexPrefix) {
+			expression := "^(?:" + strings.TrimPrefix(topic, regexPrefix) + ")$"
+			if _, err := regexp.Compile(expression); err == nil {
+				expressions = append(expressions, expression)
+			}
+			continue
+		}
+		add(topic)
+	}
+
+	sort.Strings(topics)
+	if len(expressions) == 0 {
+		return topics, nil
+	}
+
+	sort.Strings(expressions)
+	return topics, regexp.MustCompile(strings.Join(expressions, "|"))
+}
+
+// sameSubscription reports whether two subscriptions consume the same
+// topics.
+func sameSubscription(topics []string, whitelist *regexp.Regexp, otherTopics []string, otherWhitelist *regexp.Regexp) bool {
+	if len(topics) != len(otherTopics) {
+		return false
+	}
+	for i := range topics {
+		if topics[i] != otherTopics[i] {
+			return false
+		}
+	}
+
+	if whitelist == nil || otherWhitelist == nil {
+		return whitelist == otherWhitelist
+	}
+	return whitelist.String() == otherWhitelist.String()
+}
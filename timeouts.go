@@ -0,0 +1,61 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// functionTimeouts holds the timeouts functions set with the
+// upstream_timeout annotation, which replace the global upstream_timeout.
+type functionTimeouts struct {
+	overrides map[string]time.Duration
+	lock      sync.Mutex
+}
+
+func newFunctionTimeouts() *functionTimeouts {
+	return &functionTimeouts{
+		overrides: make(map[string]time.Duration),
+	}
+}
+
+// For returns the timeout of function, or fallback when it has not set
+// its own or t is nil.
+func (t *functionTimeouts) For(function string, fallback time.Duration) time.Duration {
+	if t == nil {
+		return fallback
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if timeout, ok := t.overrides[function]; ok {
+		return timeout
+	}
+	return fallback
+}
+
+// Sync replaces the per-function timeouts read from annotations.
+func (t *functionTimeouts) Sync(overrides map[string]time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.overrides = overrides
+}
+
+// parseUpstreamTimeout reads a function's upstream_timeout annotation,
+// it returns false when it is not set or is not a positive duration.
+func parseUpstreamTimeout(annotations map[string]string) (time.Duration, bool) {
+	val, ok := annotations["upstream_timeout"]
+	if !ok {
+		return 0, false
+	}
+
+	parsedVal, err := time.ParseDuration(val)
+	if err != nil || parsedVal <= 0 {
+		return 0, false
+	}
+	return parsedVal, true
+}
@@ -0,0 +1,73 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// makeTLSConfig builds a TLS configuration for connecting to the broker.
+// A CA file on its own gives server-authenticated TLS, adding a
+// certificate and key enables mutual TLS.
+func makeTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if len(certFile) > 0 && len(keyFile) == 0 {
+		return nil, fmt.Errorf("broker_cert_file was given without broker_key_file")
+	}
+	if len(keyFile) > 0 && len(certFile) == 0 {
+		return nil, fmt.Errorf("broker_key_file was given without broker_cert_file")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if len(caFile) > 0 {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read broker CA file %s: %s", caFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(caBytes); !ok {
+			return nil, fmt.Errorf("no PEM certificates found in broker CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load broker certificate and key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// makeGatewayTLSConfig builds a TLS configuration for calling the gateway
+// which trusts the certificates in caFile as well as the system roots,
+// or skips verification altogether when insecure is set.
+func makeGatewayTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if len(caFile) > 0 {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gateway CA file %s: %s", caFile, err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if ok := pool.AppendCertsFromPEM(caBytes); !ok {
+			return nil, fmt.Errorf("no PEM certificates found in gateway CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// regexPrefix marks a topic in the map as a regular expression to be
+// matched against the whole topic name rather than an exact name
+const regexPrefix = "regex:"
+
+// NewTopicMap creates an empty TopicMap
+func NewTopicMap() *TopicMap {
+	lookup := make(map[string][]string)
+	return &TopicMap{
+		lookup:   &lookup,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+}
+
+// TopicMap holds which functions should be invoked for messages on a
+// topic. Topics prefixed with "regex:" match any topic name which the
+// expression matches in full.
+//
+// A TopicMap is safe for concurrent use, Sync and Remove take the write
+// lock while Match, Topics and Snapshot take the read lock.
+type TopicMap struct {
+	lookup   *map[string][]string
+	patterns map[string]*regexp.Regexp
+	lock     sync.RWMutex
+}
+
+// Match returns the functions bound to the topic either by name or
+// by a regular expression, each function is only returned once.
+func (t *TopicMap) Match(topicName string) []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var values []string
+	seen := map[string]bool{}
+	add := func(functions []string) {
+		for _, function := range functions {
+			if !seen[function] {
+				seen[function] = true
+				values = append(values, function)
+			}
+		}
+	}
+
+	add((*t.lookup)[topicName])
+
+	for key, pattern := range t.patterns {
+		if pattern.MatchString(topicName) {
+			add((*t.lookup)[key])
+		}
+	}
+
+	return values
+}
+
+// Sync replaces the map with an updated one, compiling any regular
+// expressions which have not been seen before. Topics and functions
+// which are not in the updated map are no longer matched.
+func (t *TopicMap) Sync(updated *map[string][]string) {
+	patterns := make(map[string]*regexp.Regexp)
+
+	t.lock.RLock()
+	for key := range *updated {
+		if !strings.HasPrefix(key, regexPrefix) {
+			continue
+		}
+
+		if pattern, ok := t.patterns[key]; ok {
+			patterns[key] = pattern
+			continue
+		}
+
+		pattern, err := regexp.Compile("^(?:" + strings.TrimPrefix(key, regexPrefix) + ")$")
+		if err != nil {
+			log.Printf("Ignoring invalid topic expression %q: %s", key, err)
+			continue
+		}
+		patterns[key] = pattern
+	}
+	t.lock.RUnlock()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lookup = updated
+	t.patterns = patterns
+}
+
+// Remove unbinds a function from every topic, topics which are left
+// without any functions are removed from the map.
+func (t *TopicMap) Remove(functionName string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// The map is copied rather than modified as it is owned by the
+	// caller of Sync.
+	lookup := make(map[string][]string, len(*t.lookup))
+	for topic, functions := range *t.lookup {
+		remaining := make([]string, 0, len(functions))
+		for _, function := range functions {
+			if function != functionName {
+				remaining = append(remaining, function)
+			}
+		}
+
+		if len(remaining) > 0 {
+			lookup[topic] = remaining
+		} else {
+			delete(t.patterns, topic)
+		}
+	}
+
+	t.lookup = &lookup
+}
+
+// Topics returns the topics in the map, including any expressions
+// with their "regex:" prefix.
+func (t *TopicMap) Topics() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	topics := make([]string, 0, len(*t.lookup))
+	for topic := range *t.lookup {
+		topics = append(topics, topic)
+	}
+
+	return topics
+}
+
+// Snapshot returns a copy of the map of topics, including any
+// expressions with their "regex:" prefix, to the functions bound to them.
+func (t *TopicMap) Snapshot() map[string][]string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	snapshot := make(map[string][]string, len(*t.lookup))
+	for topic, functions := range *t.lookup {
+		snapshot[topic] = append([]string{}, functions...)
+	}
+
+	return snapshot
+}
@@ -0,0 +1,174 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func matchSorted(t *TopicMap, topic string) []string {
+	functions := t.Match(topic)
+	sort.Strings(functions)
+	return functions
+}
+
+func Test_TopicMap_SyncTransitions(t *testing.T) {
+	topicMap := NewTopicMap()
+
+	steps := []struct {
+		name    string
+		lookup  map[string][]string
+		matches map[string][]string
+	}{
+		{
+			name:   "function added",
+			lookup: map[string][]string{"orders": {"billing"}},
+			matches: map[string][]string{
+				"orders":   {"billing"},
+				"payments": nil,
+			},
+		},
+		{
+			name: "second function added to the topic",
+			lookup: map[string][]string{
+				"orders": {"billing", "shipping"},
+			},
+			matches: map[string][]string{
+				"orders": {"billing", "shipping"},
+			},
+		},
+		{
+			name: "function's topics changed",
+			lookup: map[string][]string{
+				"orders":   {"shipping"},
+				"payments": {"billing"},
+			},
+			matches: map[string][]string{
+				"orders":   {"shipping"},
+				"payments": {"billing"},
+			},
+		},
+		{
+			name: "function bound by an expression",
+			lookup: map[string][]string{
+				"orders":            {"shipping"},
+				"regex:pay(ment)?s": {"billing"},
+			},
+			matches: map[string][]string{
+				"orders":   {"shipping"},
+				"payments": {"billing"},
+				"pays":     {"billing"},
+				"payouts":  nil,
+			},
+		},
+		{
+			name:   "function dropped",
+			lookup: map[string][]string{"orders": {"shipping"}},
+			matches: map[string][]string{
+				"orders":   {"shipping"},
+				"payments": nil,
+			},
+		},
+		{
+			name:   "every function dropped",
+			lookup: map[string][]string{},
+			matches: map[string][]string{
+				"orders": nil,
+			},
+		},
+	}
+
+	for _, step := range steps {
+		lookup := step.lookup
+		topicMap.Sync(&lookup)
+
+		for topic, want := range step.matches {
+			got := matchSorted(topicMap, topic)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Match(%q) want %v, got %v", step.name, topic, want, got)
+			}
+		}
+	}
+}
+
+func Test_TopicMap_Remove(t *testing.T) {
+	topicMap := NewTopicMap()
+	lookup := map[string][]string{
+		"orders":         {"billing", "shipping"},
+		"payments":       {"billing"},
+		"regex:audit-.*": {"billing"},
+	}
+	topicMap.Sync(&lookup)
+
+	topicMap.Remove("billing")
+
+	if got := matchSorted(topicMap, "orders"); !reflect.DeepEqual(got, []string{"shipping"}) {
+		t.Errorf("Match(orders) want [shipping], got %v", got)
+	}
+	if got := topicMap.Match("payments"); len(got) != 0 {
+		t.Errorf("Match(payments) want no functions, got %v", got)
+	}
+	if got := topicMap.Match("audit-log"); len(got) != 0 {
+		t.Errorf("Match(audit-log) want no functions, got %v", got)
+	}
+
+	topics := topicMap.Topics()
+	if !reflect.DeepEqual(topics, []string{"orders"}) {
+		t.Errorf("Topics() want [orders], got %v", topics)
+	}
+
+	// The map given to Sync is owned by the caller and is left as it was.
+	if len(lookup["payments"]) != 1 {
+		t.Errorf("Remove modified the map given to Sync: %v", lookup)
+	}
+}
+
+// Test_TopicMap_ConcurrentSyncAndMatch is meant to be run with -race, it
+// syncs and removes functions while other goroutines match topics.
+func Test_TopicMap_ConcurrentSyncAndMatch(t *testing.T) {
+	topicMap := NewTopicMap()
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for _, function := range topicMap.Match("orders") {
+					if function != "billing" && function != "shipping" {
+						t.Errorf("Match(orders) returned unexpected function %q", function)
+					}
+				}
+				topicMap.Match("audit-log")
+				topicMap.Topics()
+				topicMap.Snapshot()
+			}
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		lookup := map[string][]string{
+			"orders":                           {"billing", "shipping"},
+			fmt.Sprintf("regex:audit-%d", i%5): {"billing"},
+		}
+		topicMap.Sync(&lookup)
+		if i%3 == 0 {
+			topicMap.Remove("shipping")
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,118 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"sync"
+)
+
+// maxParked is how many messages or batches can wait for their topic's
+// slots before the consumer stops reading until some are dispatched.
+const maxParked = 256
+
+// topicSlots caps how many messages or batches of each topic are
+// processed at once so a busy topic can't take every worker. Work on a
+// topic at its cap is parked in order until one of its slots is
+// released. Slots are released by workers, everything else is only used
+// from the consumer loop.
+type topicSlots struct {
+	limit    int
+	lock     sync.Mutex
+	active   map[string]int
+	released chan struct{}
+
+	parked    map[string][][]consumed
+	numParked int
+}
+
+func newTopicSlots(limit int) *topicSlots {
+	return &topicSlots{
+		limit:    limit,
+		active:   make(map[string]int),
+		released: make(chan struct{}, 1),
+		parked:   make(map[string][][]consumed),
+	}
+}
+
+// Admit takes a slot for the topic of items and returns true, or parks
+// items and returns false when the topic is at its cap or already has
+// work parked. It always returns true when s is nil.
+func (s *topicSlots) Admit(items []consumed) bool {
+	if s == nil {
+		return true
+	}
+
+	topic := items[0].msg.Topic
+	if len(s.parked[topic]) == 0 && s.take(topic) {
+		return true
+	}
+
+	s.parked[topic] = append(s.parked[topic], items)
+	s.numParked++
+	return false
+}
+
+// Ready takes a slot for as much of the parked work as possible and
+// returns it, in the order it was parked for each topic.
+func (s *topicSlots) Ready() [][]consumed {
+	ready := [][]consumed{}
+	for topic, pending := range s.parked {
+		for len(pending) > 0 && s.take(topic) {
+			ready = append(ready, pending[0])
+			pending = pending[1:]
+			s.numParked--
+		}
+
+		if len(pending) == 0 {
+			delete(s.parked, topic)
+		} else {
+			s.parked[topic] = pending
+		}
+	}
+	return ready
+}
+
+// Release frees a slot of topic, it can be called from any goroutine.
+func (s *topicSlots) Release(topic string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.active[topic]--
+	if s.active[topic] <= 0 {
+		delete(s.active, topic)
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.released <- struct{}{}:
+	default:
+	}
+}
+
+// C returns a channel which receives after a slot is released, or nil
+// when nothing is parked or s is nil.
+func (s *topicSlots) C() <-chan struct{} {
+	if s == nil || s.numParked == 0 {
+		return nil
+	}
+	return s.released
+}
+
+// Full reports whether as much work is parked as is allowed.
+func (s *topicSlots) Full() bool {
+	return s != nil && s.numParked >= maxParked
+}
+
+func (s *topicSlots) take(topic string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active[topic] >= s.limit {
+		return false
+	}
+	s.active[topic]++
+	return true
+}
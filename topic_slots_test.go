@@ -0,0 +1,142 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func topicItem(topic string, offset int64) []consumed {
+	return []consumed{{msg: &sarama.ConsumerMessage{Topic: topic, Offset: offset}}}
+}
+
+func Test_topicSlots_ParksAtLimit(t *testing.T) {
+	slots := newTopicSlots(2)
+
+	if !slots.Admit(topicItem("orders", 1)) || !slots.Admit(topicItem("orders", 2)) {
+		t.Fatalf("want work admitted up to the limit")
+	}
+	if slots.Admit(topicItem("orders", 3)) {
+		t.Fatalf("want work parked once the topic is at its limit")
+	}
+	if !slots.Admit(topicItem("payments", 1)) {
+		t.Fatalf("want other topics admitted")
+	}
+
+	// Later work waits behind the parked work even if a slot is free.
+	slots.Release("orders")
+	if slots.Admit(topicItem("orders", 4)) {
+		t.Fatalf("want work parked behind the topic's parked work")
+	}
+
+	select {
+	case <-slots.C():
+	default:
+		t.Fatalf("want C to receive once a slot is released")
+	}
+
+	ready := slots.Ready()
+	if len(ready) != 1 || ready[0][0].msg.Offset != 3 {
+		t.Fatalf("want offset 3 ready first, got %v", ready)
+	}
+
+	slots.Release("orders")
+	ready = slots.Ready()
+	if len(ready) != 1 || ready[0][0].msg.Offset != 4 {
+		t.Fatalf("want offset 4 ready next, got %v", ready)
+	}
+	if slots.C() != nil {
+		t.Fatalf("want no channel once nothing is parked")
+	}
+}
+
+func Test_topicSlots_Disabled(t *testing.T) {
+	var slots *topicSlots
+
+	if !slots.Admit(topicItem("orders", 1)) {
+		t.Fatalf("want a nil topicSlots to admit everything")
+	}
+	slots.Release("orders")
+	if slots.C() != nil || slots.Full() {
+		t.Fatalf("want a nil topicSlots to never park work")
+	}
+}
+
+func Test_topicSlots_Full(t *testing.T) {
+	slots := newTopicSlots(1)
+	slots.Admit(topicItem("orders", 0))
+
+	for offset := int64(1); offset <= maxParked; offset++ {
+		if slots.Full() {
+			t.Fatalf("want room for %d parked, full at %d", maxParked, offset-1)
+		}
+		slots.Admit(topicItem("orders", offset))
+	}
+	if !slots.Full() {
+		t.Fatalf("want full with %d parked", maxParked)
+	}
+}
+
+// Test_topicSlots_CapsConcurrency dispatches work to workers as the
+// consumer loop does, it is meant to be run with -race.
+func Test_topicSlots_CapsConcurrency(t *testing.T) {
+	const limit = 2
+
+	slots := newTopicSlots(limit)
+	lock := sync.Mutex{}
+	active := map[string]int{}
+	peak := map[string]int{}
+	done := map[string]int{}
+	wg := sync.WaitGroup{}
+
+	work := func(items []consumed) {
+		topic := items[0].msg.Topic
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer slots.Release(topic)
+
+			lock.Lock()
+			active[topic]++
+			if active[topic] > peak[topic] {
+				peak[topic] = active[topic]
+			}
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			active[topic]--
+			done[topic]++
+			lock.Unlock()
+		}()
+	}
+
+	topics := []string{"orders", "payments"}
+	for offset := int64(0); offset < 40; offset++ {
+		if items := topicItem(topics[offset%2], offset); slots.Admit(items) {
+			work(items)
+		}
+	}
+	for released := slots.C(); released != nil; released = slots.C() {
+		<-released
+		for _, items := range slots.Ready() {
+			work(items)
+		}
+	}
+	wg.Wait()
+
+	for _, topic := range topics {
+		if done[topic] != 20 {
+			t.Errorf("want 20 messages processed for %s, got %d", topic, done[topic])
+		}
+		if peak[topic] > limit {
+			t.Errorf("want at most %d of %s processed at once, got %d", limit, topic, peak[topic])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// spanExporter exports spans to an OpenTelemetry collector with OTLP
+// over HTTP using the JSON encoding, in batches.
+type spanExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *span
+}
+
+// tracer is set when otel_endpoint is configured, otherwise the trace
+// context of messages is forwarded to functions as it is.
+var tracer *spanExporter
+
+const (
+	exportBatchSize = 512
+	exportInterval  = 5 * time.Second
+)
+
+func startTracing(endpoint string) {
+	tracer = &spanExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, exportBatchSize*4),
+	}
+	go tracer.run()
+}
+
+// span is an invocation of a function for a message, it is the child of
+// the span which produced the message when the message has a W3C
+// traceparent header, or the root of a new trace otherwise.
+type span struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	flags      string
+	traceState string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+// startSpan starts a span for invoking function with msg, it returns
+// nil when tracing is not enabled.
+func startSpan(msg *sarama.ConsumerMessage, function string) *span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := &span{
+		traceID: randomHex(16),
+		spanID:  randomHex(8),
+		flags:   "01",
+		name:    "invoke " + function,
+		start:   time.Now(),
+		attributes: map[string]string{
+			"messaging.system":               "kafka",
+			"messaging.destination":          msg.Topic,
+			"messaging.kafka.partition":      strconv.Itoa(int(msg.Partition)),
+			"messaging.kafka.message_offset": strconv.FormatInt(msg.Offset, 10),
+			"faas.invoked_name":              function,
+		},
+	}
+
+	if traceID, parentID, flags, ok := parseTraceparent(recordHeader(msg, "traceparent")); ok {
+		s.traceID, s.parentID, s.flags = traceID, parentID, flags
+		s.traceState = recordHeader(msg, "tracestate")
+	}
+
+	return s
+}
+
+// traceparent returns the W3C traceparent header which makes the span
+// the parent of the function's own spans.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%s", s.traceID, s.spanID, s.flags)
+}
+
+// End completes the span with the result of the invocation and queues
+// it for export, spans are dropped when the queue is full.
+func (s *span) End(status int, err error) {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.attributes["http.status_code"] = strconv.Itoa(status)
+	s.err = err
+
+	select {
+	case tracer.spans <- s:
+	default:
+	}
+}
+
+// injectTraceContext sets the trace context headers on an invocation,
+// from the span when tracing is enabled or as they are on the message.
+func injectTraceContext(httpReq *http.Request, msg *sarama.ConsumerMessage, s *span) {
+	if s != nil {
+		httpReq.Header.Set("traceparent", s.traceparent())
+		if len(s.traceState) > 0 {
+			httpReq.Header.Set("tracestate", s.traceState)
+		}
+		return
+	}
+
+	if val := recordHeader(msg, "traceparent"); len(val) > 0 {
+		httpReq.Header.Set("traceparent", sanitizeHeaderValue(val))
+		if state := recordHeader(msg, "tracestate"); len(state) > 0 {
+			httpReq.Header.Set("tracestate", sanitizeHeaderValue(state))
+		}
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, exportBatchSize)
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := e.export(batch); err != nil {
+			logEvent(levelWarn, "Unable to export spans", logFields{
+				"spans": len(batch),
+				"error": err.Error(),
+			})
+		}
+		batch = batch[:0]
+	}
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *spanExporter) export(batch []*span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		status := otlpStatus{Code: 1}
+		if s.err != nil {
+			status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+
+		spans = append(spans, otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			TraceState:        s.traceState,
+			Name:              s.name,
+			Kind:              3, // SPAN_KIND_CLIENT
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            status,
+		})
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": "kafka-connector"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "kafka-connector"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", e.endpoint, res.StatusCode)
+	}
+	return nil
+}
+
+func otlpAttributes(values map[string]string) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(values))
+	for key, value := range values {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}})
+	}
+	return attributes
+}
+
+// parseTraceparent reads the trace ID, parent span ID and flags from a
+// version 00 W3C traceparent header.
+func parseTraceparent(value string) (string, string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil || strings.ToLower(part) != part {
+			return "", "", "", false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", "", false
+	}
+
+	return parts[1], parts[2], parts[3], true
+}
+
+// recordHeader returns the value of the first record header on msg with
+// the given key, compared case-insensitively.
+func recordHeader(msg *sarama.ConsumerMessage, key string) string {
+	for _, header := range msg.Headers {
+		if header != nil && strings.EqualFold(string(header.Key), key) {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
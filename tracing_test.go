@@ -0,0 +1,213 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+func Test_parseTraceparent(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "sampled", value: "00-" + testTraceID + "-" + testParentID + "-01", valid: true},
+		{name: "not sampled", value: "00-" + testTraceID + "-" + testParentID + "-00", valid: true},
+		{name: "future version with more fields", value: "01-" + testTraceID + "-" + testParentID + "-01-extra", valid: true},
+		{name: "empty", value: "", valid: false},
+		{name: "invalid version", value: "ff-" + testTraceID + "-" + testParentID + "-01", valid: false},
+		{name: "short trace ID", value: "00-4bf92f35-" + testParentID + "-01", valid: false},
+		{name: "zero trace ID", value: "00-" + strings.Repeat("0", 32) + "-" + testParentID + "-01", valid: false},
+		{name: "zero parent ID", value: "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", valid: false},
+		{name: "upper case", value: "00-" + strings.ToUpper(testTraceID) + "-" + testParentID + "-01", valid: false},
+		{name: "not hex", value: "00-" + strings.Repeat("z", 32) + "-" + testParentID + "-01", valid: false},
+	}
+
+	for _, c := range cases {
+		traceID, parentID, flags, ok := parseTraceparent(c.value)
+		if ok != c.valid {
+			t.Errorf("%s: want valid %t, got %t", c.name, c.valid, ok)
+			continue
+		}
+		if ok && (traceID != testTraceID || parentID != testParentID || len(flags) != 2) {
+			t.Errorf("%s: want %s %s, got %s %s %s", c.name, testTraceID, testParentID, traceID, parentID, flags)
+		}
+	}
+}
+
+func tracedMessage() *sarama.ConsumerMessage {
+	msg := testMessage(1)
+	msg.Headers = []*sarama.RecordHeader{
+		{Key: []byte("traceparent"), Value: []byte("00-" + testTraceID + "-" + testParentID + "-01")},
+		{Key: []byte("tracestate"), Value: []byte("vendor=value")},
+	}
+	return msg
+}
+
+// newTraceHeadersServer is a gateway which records the trace context
+// headers of the last invocation.
+func newTraceHeadersServer() (*httptest.Server, *http.Header) {
+	received := &http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header
+	}))
+	return server, received
+}
+
+func Test_invokeFunction_StartsChildSpan(t *testing.T) {
+	gateway, received := newTraceHeadersServer()
+	defer gateway.Close()
+
+	tracer = &spanExporter{spans: make(chan *span, 1)}
+	defer func() { tracer = nil }()
+
+	config := testConfig(map[string]string{"gateway_url": gateway.URL})
+	invokeFunction(makeClient(time.Second, config), newRateLimiters(config.RateLimit), config, "billing", tracedMessage(), 0)
+
+	traceID, spanID, flags, ok := parseTraceparent(received.Get("traceparent"))
+	if !ok {
+		t.Fatalf("want a valid traceparent, got %q", received.Get("traceparent"))
+	}
+	if traceID != testTraceID || flags != "01" {
+		t.Errorf("want the message's trace and flags continued, got %s %s", traceID, flags)
+	}
+	if spanID == testParentID {
+		t.Errorf("want a new span as the parent of the function's spans")
+	}
+	if got := received.Get("tracestate"); got != "vendor=value" {
+		t.Errorf("want tracestate forwarded, got %q", got)
+	}
+
+	select {
+	case s := <-tracer.spans:
+		if s.traceID != testTraceID || s.parentID != testParentID || s.spanID != spanID {
+			t.Errorf("want the span exported as a child of the message's span, got %+v", s)
+		}
+		if s.name != "invoke billing" || s.attributes["http.status_code"] != "200" {
+			t.Errorf("want the span named for the function with its status, got %s %v", s.name, s.attributes)
+		}
+	default:
+		t.Fatalf("want the span queued for export")
+	}
+}
+
+func Test_invokeFunction_ForwardsTraceContextWithoutTracing(t *testing.T) {
+	gateway, received := newTraceHeadersServer()
+	defer gateway.Close()
+
+	config := testConfig(map[string]string{"gateway_url": gateway.URL})
+	invokeFunction(makeClient(time.Second, config), newRateLimiters(config.RateLimit), config, "billing", tracedMessage(), 0)
+
+	if got, want := received.Get("traceparent"), "00-"+testTraceID+"-"+testParentID+"-01"; got != want {
+		t.Errorf("want traceparent forwarded as %s, got %q", want, got)
+	}
+	if got := received.Get("tracestate"); got != "vendor=value" {
+		t.Errorf("want tracestate forwarded, got %q", got)
+	}
+}
+
+func Test_spanExporter_Export(t *testing.T) {
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	path, contentType := "", ""
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("want a JSON payload, got %s", body)
+		}
+	}))
+	defer collector.Close()
+
+	exporter := &spanExporter{endpoint: collector.URL + "/v1/traces", client: &http.Client{Timeout: time.Second}}
+	start := time.Unix(1500000000, 0)
+	spans := []*span{
+		{
+			traceID: testTraceID, spanID: "b7ad6b7169203331", parentID: testParentID,
+			traceState: "vendor=value", name: "invoke billing",
+			start: start, end: start.Add(time.Second),
+			attributes: map[string]string{"messaging.destination": "orders"},
+		},
+		{
+			traceID: testTraceID, spanID: "c7ad6b7169203331", name: "invoke shipping",
+			start: start, end: start.Add(time.Second),
+			attributes: map[string]string{}, err: errors.New("shipping returned status 500"),
+		},
+	}
+
+	if err := exporter.export(spans); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/traces" || contentType != "application/json" {
+		t.Errorf("want JSON posted to /v1/traces, got %s to %s", contentType, path)
+	}
+	if len(payload.ResourceSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("want one resource and scope, got %+v", payload)
+	}
+	resource := payload.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || resource[0].Value["stringValue"] != "kafka-connector" {
+		t.Errorf("want the service.name resource attribute, got %v", resource)
+	}
+
+	exported := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(exported) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(exported))
+	}
+	ok, failed := exported[0], exported[1]
+	if ok.TraceID != testTraceID || ok.SpanID != "b7ad6b7169203331" || ok.ParentSpanID != testParentID || ok.TraceState != "vendor=value" {
+		t.Errorf("want the span's IDs exported, got %+v", ok)
+	}
+	if ok.Kind != 3 || ok.StartTimeUnixNano != "1500000000000000000" || ok.EndTimeUnixNano != "1500000001000000000" {
+		t.Errorf("want a client span with its times in nanoseconds, got %+v", ok)
+	}
+	if len(ok.Attributes) != 1 || ok.Attributes[0].Key != "messaging.destination" || ok.Attributes[0].Value["stringValue"] != "orders" {
+		t.Errorf("want the span's attributes exported, got %v", ok.Attributes)
+	}
+	if ok.Status.Code != 1 || failed.Status.Code != 2 || failed.Status.Message != "shipping returned status 500" {
+		t.Errorf("want ok and error statuses, got %+v and %+v", ok.Status, failed.Status)
+	}
+	if failed.ParentSpanID != "" {
+		t.Errorf("want a root span without a parent, got %s", failed.ParentSpanID)
+	}
+}
+
+func Test_spanExporter_ExportError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	exporter := &spanExporter{endpoint: collector.URL + "/v1/traces", client: &http.Client{Timeout: time.Second}}
+	s := &span{traceID: testTraceID, spanID: testParentID, attributes: map[string]string{}}
+	if err := exporter.export([]*span{s}); err == nil {
+		t.Fatalf("want an error when the collector fails")
+	}
+}
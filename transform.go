@@ -0,0 +1,103 @@
+// Copyright (c) OpenFaaS Project 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// templateMessage is the data a body template is executed with. Value
+// and Key are inserted as they are, so a JSON value can be embedded in a
+// JSON envelope with {{.Value}}.
+type templateMessage struct {
+	Value     string
+	Key       string
+	Topic     string
+	Partition int32
+	Offset    int64
+	Headers   map[string]string
+}
+
+// parseBodyTemplate compiles the template given in body_template.
+func parseBodyTemplate(text string) (*template.Template, error) {
+	return template.New("body_template").Parse(text)
+}
+
+// transformMessage returns a copy of msg with its value replaced by the
+// output of tmpl executed with the message.
+func transformMessage(tmpl *template.Template, msg *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	data := templateMessage{
+		Value:     string(msg.Value),
+		Key:       string(msg.Key),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Headers:   make(map[string]string, len(msg.Headers)),
+	}
+	for _, header := range msg.Headers {
+		if header != nil {
+			data.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+
+	body := bytes.Buffer{}
+	if err := tmpl.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	transformed := *msg
+	transformed.Value = body.Bytes()
+	return &transformed, nil
+}
+
+// messageEnvelope is the JSON body sent to functions with envelope set.
+// The key and value are base64 encoded and null when they are empty.
+type messageEnvelope struct {
+	Topic     string            `json:"topic"`
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Key       []byte            `json:"key"`
+	Headers   map[string]string `json:"headers"`
+	Value     []byte            `json:"value"`
+}
+
+// envelopeMessage returns a copy of msg with its value replaced by a
+// JSON envelope of the whole message.
+func envelopeMessage(msg *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	envelope := messageEnvelope{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Headers:   make(map[string]string, len(msg.Headers)),
+	}
+	if !msg.Timestamp.IsZero() {
+		envelope.Timestamp = &msg.Timestamp
+	}
+	if len(msg.Key) > 0 {
+		envelope.Key = msg.Key
+	}
+	if len(msg.Value) > 0 {
+		envelope.Value = msg.Value
+	}
+	for _, header := range msg.Headers {
+		if header != nil {
+			envelope.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	enveloped := *msg
+	enveloped.Value = body
+	return &enveloped, nil
+}